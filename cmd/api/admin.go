@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"personalized_gifts.sanzhar.net/internal/data"
+	"personalized_gifts.sanzhar.net/internal/validator"
+)
+
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Search string
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	// The "search" parameter matches part of a user's name or email address.
+	input.Search = app.readString(qs, "search", "")
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = []string{"id", "name", "email", "created_at", "-id", "-name", "-email", "-created_at"}
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	users, metadata, err := app.models.Users.GetAll(input.Search, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The getUserParam() helper fetches the user named by the "id" URL parameter, sending
+// a 404 Not Found response and returning nil if there isn't one.
+func (app *application) getUserParam(w http.ResponseWriter, r *http.Request) *data.User {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+	user, err := app.models.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return user
+}
+
+// The writeUserWithPermissions() helper sends a user along with their roles and all
+// of their permission codes (both direct and from their roles).
+func (app *application) writeUserWithPermissions(w http.ResponseWriter, r *http.Request, user *data.User) {
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+	roles, err := app.models.Roles.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	roleNames := make([]string, len(roles))
+	for i, role := range roles {
+		roleNames[i] = role.Name
+	}
+	// Include when logins for the user are locked until, which is null when they aren't.
+	lockedUntil, err := app.models.Logins.LockedUntil(user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user, "roles": roleNames, "permissions": permissions, "locked_until": lockedUntil}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getUserParam(w, r)
+	if user == nil {
+		return
+	}
+	app.writeUserWithPermissions(w, r, user)
+}
+
+// Deactivate or reactivate a user's account. Deactivating an account also logs the
+// user out everywhere.
+func (app *application) updateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getUserParam(w, r)
+	if user == nil {
+		return
+	}
+	var input struct {
+		Disabled *bool `json:"disabled"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(input.Disabled != nil, "disabled", "must be provided")
+	if input.Disabled != nil && *input.Disabled {
+		v.Check(user.ID != app.contextGetUser(r).ID, "disabled", "you can't disable your own account")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	user.Disabled = *input.Disabled
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if user.Disabled {
+		for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh} {
+			err = app.models.Tokens.DeleteAllForUser(scope, user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+		err = app.revokeAllJWTs(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	app.writeUserWithPermissions(w, r, user)
+}
+
+// Unlock logins for a user whose account was locked after too many failed attempts.
+// This also forgets the failures, so the user gets the full number of attempts again.
+func (app *application) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getUserParam(w, r)
+	if user == nil {
+		return
+	}
+	err := app.models.Logins.Clear(user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.writeUserWithPermissions(w, r, user)
+}
+
+// The validatePermissionCodes() helper checks that every code in a request exists,
+// adding any errors under the given key.
+func (app *application) validatePermissionCodes(v *validator.Validator, key string, codes []string) error {
+	known, err := app.models.Permissions.GetAll()
+	if err != nil {
+		return err
+	}
+	for _, code := range codes {
+		v.Check(validator.In(code, known...), key, "must only contain known permission codes")
+	}
+	v.Check(validator.Unique(codes), key, "must not contain duplicate values")
+	return nil
+}
+
+func (app *application) grantUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getUserParam(w, r)
+	if user == nil {
+		return
+	}
+	var input struct {
+		Codes []string `json:"codes"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(len(input.Codes) > 0, "codes", "must contain at least 1 permission code")
+	err = app.validatePermissionCodes(v, "codes", input.Codes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Permissions.AddForUser(user.ID, input.Codes...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.writeUserWithPermissions(w, r, user)
+}
+
+func (app *application) revokeUserPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getUserParam(w, r)
+	if user == nil {
+		return
+	}
+	code := httprouter.ParamsFromContext(r.Context()).ByName("code")
+	err := app.models.Permissions.RemoveForUser(user.ID, code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// JWTs carry a copy of the user's permissions, so revoke any that have been
+	// issued. The user's next refresh gets a token without the permission.
+	err = app.revokeAllJWTs(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.writeUserWithPermissions(w, r, user)
+}
+
+func (app *application) listPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	permissions, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
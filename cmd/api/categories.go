@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"personalized_gifts.sanzhar.net/internal/data"
+	"personalized_gifts.sanzhar.net/internal/validator"
+)
+
+// The setGiftCategory() helper looks up a category by its slug and assigns it to the
+// gift. If there is no such category, an error message is recorded in the provided
+// Validator instance; only unexpected database errors are returned.
+func (app *application) setGiftCategory(gift *data.Gift, slug string, v *validator.Validator) error {
+	if slug == "" {
+		v.AddError("category", "must be provided")
+		return nil
+	}
+	category, err := app.models.Categories.GetBySlug(slug)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("category", "must be the slug of an existing category")
+			return nil
+		default:
+			return err
+		}
+	}
+	gift.CategoryID = category.ID
+	gift.Category = category.Slug
+	return nil
+}
+
+func (app *application) listCategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	categories, err := app.models.Categories.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"categories": categories}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	category, err := app.models.Categories.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"category": category}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Slug     string `json:"slug"`
+		Name     string `json:"name"`
+		ParentID *int64 `json:"parent_id"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	category := &data.Category{
+		Slug:     input.Slug,
+		Name:     input.Name,
+		ParentID: input.ParentID,
+	}
+	v := validator.New()
+	if data.ValidateCategory(v, category); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Categories.Insert(category)
+	if err != nil {
+		app.categoryErrorResponse(w, r, v, err)
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/categories/%d", category.ID))
+	err = app.writeJSON(w, http.StatusCreated, envelope{"category": category}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	category, err := app.models.Categories.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// ParentID is read as raw JSON so that we can tell the difference between the key
+	// being left out (keep the current parent) and being set to null (make this a
+	// top-level category). A *int64 would be nil in both cases.
+	var input struct {
+		Slug     *string         `json:"slug"`
+		Name     *string         `json:"name"`
+		ParentID json.RawMessage `json:"parent_id"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if input.Slug != nil {
+		category.Slug = *input.Slug
+	}
+	if input.Name != nil {
+		category.Name = *input.Name
+	}
+	if input.ParentID != nil {
+		var parentID *int64
+		err = json.Unmarshal(input.ParentID, &parentID)
+		if err != nil {
+			app.badRequestResponse(w, r, errors.New("body contains incorrect JSON type for field \"parent_id\""))
+			return
+		}
+		category.ParentID = parentID
+	}
+	v := validator.New()
+	if data.ValidateCategory(v, category); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Categories.Update(category)
+	if err != nil {
+		app.categoryErrorResponse(w, r, v, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"category": category}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	err = app.models.Categories.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrCategoryInUse):
+			message := "the category still has gifts or subcategories, move them to another category first"
+			app.errorResponse(w, r, http.StatusConflict, message)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "category successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The categoryErrorResponse() helper sends the right response for the errors returned
+// when inserting or updating a category.
+func (app *application) categoryErrorResponse(w http.ResponseWriter, r *http.Request, v *validator.Validator, err error) {
+	switch {
+	case errors.Is(err, data.ErrDuplicateSlug):
+		v.AddError("slug", "a category with this slug already exists")
+		app.failedValidationResponse(w, r, v.Errors)
+	case errors.Is(err, data.ErrParentNotFound):
+		v.AddError("parent_id", "must be the id of an existing category")
+		app.failedValidationResponse(w, r, v.Errors)
+	case errors.Is(err, data.ErrCategoryCycle):
+		v.AddError("parent_id", "must not be one of the category's own subcategories")
+		app.failedValidationResponse(w, r, v.Errors)
+	case errors.Is(err, data.ErrEditConflict):
+		app.editConflictResponse(w, r)
+	default:
+		app.serverErrorResponse(w, r, err)
+	}
+}
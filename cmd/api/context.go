@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"personalized_gifts.sanzhar.net/internal/data"
+	"personalized_gifts.sanzhar.net/internal/jwt"
 )
 
 // Define a custom contextKey type, with the underlying type string.
@@ -15,6 +16,18 @@ type contextKey string
 // setting user information in the request context.
 const userContextKey = contextKey("user")
 
+// The tokenContextKey is used to store the plaintext authentication token that the
+// request was made with, so that the token itself can be revoked.
+const tokenContextKey = contextKey("token")
+
+// The claimsContextKey is used to store the claims of the JWT that the request was
+// authenticated with, in JWT mode.
+const claimsContextKey = contextKey("claims")
+
+// The apiKeyContextKey is used to store the API key that the request was
+// authenticated with, if any.
+const apiKeyContextKey = contextKey("api_key")
+
 // The contextSetUser() method returns a new copy of the request with the provided User struct added to the context.
 // Note that we use our userContextKey constant as the key.
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
@@ -33,3 +46,45 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+// The contextSetToken() method returns a new copy of the request with the plaintext
+// authentication token added to the context.
+func (app *application) contextSetToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// The contextGetToken() method returns the plaintext authentication token from the
+// request context, or the empty string for anonymous requests.
+func (app *application) contextGetToken(r *http.Request) string {
+	token, _ := r.Context().Value(tokenContextKey).(string)
+	return token
+}
+
+// The contextSetClaims() method returns a new copy of the request with the JWT claims
+// added to the context.
+func (app *application) contextSetClaims(r *http.Request, claims *jwt.Claims) *http.Request {
+	ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+	return r.WithContext(ctx)
+}
+
+// The contextGetClaims() method returns the JWT claims from the request context, or
+// nil if the request wasn't authenticated with a JWT.
+func (app *application) contextGetClaims(r *http.Request) *jwt.Claims {
+	claims, _ := r.Context().Value(claimsContextKey).(*jwt.Claims)
+	return claims
+}
+
+// The contextSetAPIKey() method returns a new copy of the request with the API key
+// added to the context.
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// The contextGetAPIKey() method returns the API key from the request context, or nil
+// if the request wasn't authenticated with one.
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	return key
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
@@ -98,3 +101,50 @@ func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Requ
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) disabledAccountResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account has been disabled"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// The setRetryAfter() helper tells the client how many seconds to wait before trying
+// again, rounding up so that it never retries too early.
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	seconds := int64(math.Ceil(d.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+}
+
+func (app *application) loginThrottledResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	setRetryAfter(w, retryAfter)
+	message := "too many failed login attempts, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+func (app *application) accountLockedResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	setRetryAfter(w, retryAfter)
+	message := "this account is temporarily locked because of too many failed login attempts"
+	app.errorResponse(w, r, http.StatusLocked, message)
+}
+
+func (app *application) mfaRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account is required to use two-factor authentication"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) apiKeyNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource can't be accessed with an API key"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) oidcLoginFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the identity provider couldn't confirm who you are"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *application) unverifiedIdentityResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your identity provider hasn't given us a verified email address"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
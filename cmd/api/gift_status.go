@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"personalized_gifts.sanzhar.net/internal/data"
+	"personalized_gifts.sanzhar.net/internal/validator"
+)
+
+func (app *application) createGiftTransitionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	var input struct {
+		Status string `json:"status"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(input.Status != "", "status", "must be provided")
+	v.Check(validator.In(input.Status, data.GiftStatuses...), "status", "must be one of not-ready, in-process or ready")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	gift, err := app.models.Gifts.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Record the user who made the change alongside the transition itself.
+	user := app.contextGetUser(r)
+	from := gift.Status
+	change, err := app.models.Statuses.Transition(gift, input.Status, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidTransition):
+			v.AddError("status", fmt.Sprintf("cannot move from %s to %s", from, input.Status))
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusCreated, envelope{"gift": gift, "transition": change}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listGiftHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	// Check the gift exists first, so that we can tell the difference between a gift
+	// with no history yet and a gift which doesn't exist at all.
+	_, err = app.models.Gifts.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	history, err := app.models.Statuses.GetAllForGift(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"history": history}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
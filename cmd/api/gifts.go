@@ -10,11 +10,14 @@ import (
 
 func (app *application) createGiftHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title       string `json:"title"`
-		Description string `json:"description"`
-		Superiority string `json:"superiority"`
-		Status      string `json:"status"`
-		Category    string `json:"category"`
+		Title       string           `json:"title"`
+		Description string           `json:"description"`
+		Superiority string           `json:"superiority"`
+		Status      string           `json:"status"`
+		Category    string           `json:"category"`
+		Preparation data.Preparation `json:"preparation"`
+		BasePrice   data.Price       `json:"base_price"`
+		Tags        []string         `json:"tags"`
 	}
 	err := app.readJSON(w, r, &input)
 	if err != nil {
@@ -22,16 +25,37 @@ func (app *application) createGiftHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// Copy the values from the input struct to a new Movie struct.
+	// Copy the values from the input struct to a new Movie struct. The gift belongs
+	// to the user creating it.
+	user := app.contextGetUser(r)
 	gift := &data.Gift{
+		CreatedBy:   &user.ID,
 		Title:       input.Title,
 		Description: input.Description,
 		Superiority: input.Superiority,
 		Status:      input.Status,
-		Category:    input.Category,
+		Preparation: input.Preparation,
+		BasePrice:   input.BasePrice,
+		Tags:        input.Tags,
+	}
+	// Tags are optional, but we always store an array rather than NULL.
+	if gift.Tags == nil {
+		gift.Tags = []string{}
+	}
+	// Gifts always start their lifecycle as "not-ready"; later status changes must go
+	// through the transitions endpoint so that they are recorded in the history.
+	if gift.Status == "" {
+		gift.Status = data.StatusNotReady
 	}
 	// Initialize a new Validator.
 	v := validator.New()
+	v.Check(gift.Status == data.StatusNotReady, "status", "new gifts must have the status not-ready")
+	// Look up the category by its slug.
+	err = app.setGiftCategory(gift, input.Category, v)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 	// Call the ValidateMovie() function and return a response containing the errors if
 	// any of the checks fail.
 	if data.ValidateGift(v, gift); !v.Valid() {
@@ -80,6 +104,11 @@ func (app *application) showGiftHandler(w http.ResponseWriter, r *http.Request)
 		}
 		return
 	}
+	err = app.attachImages(gift)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 	err = app.writeJSON(w, http.StatusOK, envelope{"gift": gift}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -109,11 +138,14 @@ func (app *application) updateGiftHandler(w http.ResponseWriter, r *http.Request
 
 	// Declare an input struct to hold the expected data from the client.
 	var input struct {
-		Title       *string `json:"title"`
-		Description *string `json:"description"`
-		Superiority *string `json:"superiority"`
-		Status      *string `json:"status"`
-		Category    *string `json:"category"`
+		Title       *string           `json:"title"`
+		Description *string           `json:"description"`
+		Superiority *string           `json:"superiority"`
+		Status      *string           `json:"status"`
+		Category    *string           `json:"category"`
+		Preparation *data.Preparation `json:"preparation"`
+		BasePrice   *data.Price       `json:"base_price"`
+		Tags        []string          `json:"tags"`
 	}
 
 	// Read the JSON request body data into the input struct.
@@ -133,16 +165,39 @@ func (app *application) updateGiftHandler(w http.ResponseWriter, r *http.Request
 	if input.Superiority != nil {
 		gift.Superiority = *input.Superiority
 	}
-	if input.Status != nil {
-		gift.Status = *input.Status
+	if input.Preparation != nil {
+		gift.Preparation = *input.Preparation
 	}
-	if input.Category != nil {
-		gift.Category = *input.Category
+	if input.BasePrice != nil {
+		gift.BasePrice = *input.BasePrice
+	}
+	// We don't need to dereference the input.Tags field, because slices already have
+	// the zero-value nil.
+	if input.Tags != nil {
+		gift.Tags = input.Tags
 	}
 
-	// Validate the updated gift.
+	// Validate the updated gift. The status can't be changed here, as that would
+	// bypass the lifecycle rules and the status history.
 	v := validator.New()
-	if data.ValidateGift(v, gift); !v.Valid() {
+	if input.Status != nil {
+		v.Check(*input.Status == gift.Status, "status", "must be changed via POST /v1/gifts/:id/transitions")
+	}
+	if input.Category != nil {
+		err = app.setGiftCategory(gift, *input.Category, v)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	data.ValidateGiftDetails(v, gift)
+	if input.Preparation != nil {
+		data.ValidatePreparation(v, gift.Preparation)
+	}
+	if input.BasePrice != nil {
+		data.ValidatePrice(v, "base_price", gift.BasePrice)
+	}
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
@@ -184,6 +239,12 @@ func (app *application) deleteGiftHandler(w http.ResponseWriter, r *http.Request
 		}
 		return
 	}
+	// The gift's images were deleted along with it, so remove their files too. As
+	// when deleting a single image, a failure here only leaves orphaned files behind.
+	err = app.storage.Delete(giftStoragePrefix(id))
+	if err != nil {
+		app.logError(r, err)
+	}
 	// Return a 200 OK status code along with a success message.
 	err = app.writeJSON(w, http.StatusOK, envelope{"message": "gift successfully deleted"}, nil)
 	if err != nil {
@@ -191,18 +252,55 @@ func (app *application) deleteGiftHandler(w http.ResponseWriter, r *http.Request
 	}
 }
 func (app *application) listGiftsHandler(w http.ResponseWriter, r *http.Request) {
+	app.listGifts(w, r, 0)
+}
+
+// List the gifts created by the user making the request. It takes all of the same
+// filters as listGiftsHandler.
+func (app *application) listMyGiftsHandler(w http.ResponseWriter, r *http.Request) {
+	app.listGifts(w, r, app.contextGetUser(r).ID)
+}
+
+// The listGifts() helper sends a page of gifts matching the query string. If createdBy
+// isn't zero, only gifts created by that user are included.
+func (app *application) listGifts(w http.ResponseWriter, r *http.Request, createdBy int64) {
 	var input struct {
-		Title        string
+		data.GiftQuery
 		data.Filters // Assuming data.Filters is a struct type
 	}
 	// Initialize a new Validator instance.
 	v := validator.New()
 	// Call r.URL.Query() to get the url.Values map containing the query string data.
 	qs := r.URL.Query()
-	// Use our helpers to extract the title and genres query string values, falling back
-	// to defaults of an empty string and an empty slice respectively if they are not
-	// provided by the client.
+	// Use our helpers to extract the title and filter query string values, falling
+	// back to defaults of an empty string and an empty slice respectively if they are
+	// not provided by the client. The status, superiority and category values can be
+	// given either once or as a comma-separated list, like "?status=not-ready,ready".
 	input.Title = app.readString(qs, "title", "")
+	// The "search" parameter runs a ranked full-text search over the title and
+	// description, and adds highlighted snippets to each gift in the response.
+	input.Search = app.readString(qs, "search", "")
+	input.Statuses = app.readCSV(qs, "status", []string{})
+	input.Superiorities = app.readCSV(qs, "superiority", []string{})
+	input.Categories = app.readCSV(qs, "category", []string{})
+	// Tags can be filtered with "has all of" semantics ("?tags=birthday,eco") or "has
+	// any of" semantics ("?tags_any=for-mom,for-dad"), or both at once.
+	input.AllTags = app.readCSV(qs, "tags", []string{})
+	input.AnyTags = app.readCSV(qs, "tags_any", []string{})
+	// Read the optional preparation time range (in minutes). Zero means the bound is
+	// not applied, so "min_preparation=0" is the same as leaving it out.
+	input.MinPreparation = app.readInt(qs, "min_preparation", 0, v)
+	input.MaxPreparation = app.readInt(qs, "max_preparation", 0, v)
+	// Read the optional price range, given as decimal amounts like "12.50" in the
+	// currency from the "currency" parameter (USD if it isn't provided).
+	input.Currency = app.readString(qs, "currency", "")
+	if qs.Get("min_price") != "" || qs.Get("max_price") != "" {
+		if input.Currency == "" {
+			input.Currency = "USD"
+		}
+		input.MinPrice = app.readAmount(qs, "min_price", input.Currency, v)
+		input.MaxPrice = app.readAmount(qs, "max_price", input.Currency, v)
+	}
 
 	// Get the page and page_size query string values as integers. Notice that we set
 	// the default page value to 1 and default page_size to 20, and that we pass the
@@ -212,22 +310,53 @@ func (app *application) listGiftsHandler(w http.ResponseWriter, r *http.Request)
 	// Extract the sort query string value, falling back to "id" if it is not provided
 	// by the client (which will imply an ascending sort on movie ID).
 	input.Filters.Sort = app.readString(qs, "sort", "id")
-	input.Filters.SortSafelist = []string{"id", "title", "description", "superiority", "status", "category", "-id", "-title", "-description", "-superiority", "-status", "-category"}
+	// Passing a "cursor" parameter (even an empty one, for the first page) switches
+	// the listing to keyset pagination. The next_cursor and prev_cursor values from
+	// the response metadata can then be passed back to move through the results.
+	input.Filters.CursorMode = qs.Has("cursor")
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
+	input.Filters.SortSafelist = []string{"id", "title", "description", "superiority", "status", "category", "preparation", "-id", "-title", "-description", "-superiority", "-status", "-category", "-preparation", "price", "-price", "relevance"}
+	input.Filters.IntegerSorts = map[string]int{"id": 64, "preparation": 32, "price": 64}
 
+	input.CreatedBy = createdBy
+	data.ValidateGiftQuery(v, input.GiftQuery)
+	// Relevance only makes sense for a search, and the rank of a row isn't a stable
+	// value we can build a cursor from.
+	if input.Filters.Sort == "relevance" {
+		v.Check(input.Search != "", "sort", "relevance can only be used with the search parameter")
+		v.Check(!input.Filters.CursorMode, "sort", "relevance can't be used with cursor pagination")
+	}
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	gifts, metadata, err := app.models.Gifts.GetAll(input.Title, input.Filters)
+	gifts, metadata, err := app.models.Gifts.GetAll(input.GiftQuery, input.Filters)
 	if err != nil {
 		app.logError(r, err) // Log the error with detailed information.
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+	err = app.attachImages(gifts...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 	// Send a JSON response containing the movie data.
 	err = app.writeJSON(w, http.StatusOK, envelope{"gifts": gifts, "metadata": metadata}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+func (app *application) listTagsHandler(w http.ResponseWriter, r *http.Request) {
+	tags, err := app.models.Gifts.GetTagCounts()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"tags": tags}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
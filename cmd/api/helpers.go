@@ -6,8 +6,11 @@ import (
 	"fmt"
 	"github.com/julienschmidt/httprouter"
 	"io"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"personalized_gifts.sanzhar.net/internal/data"
 	"personalized_gifts.sanzhar.net/internal/validator"
 	"strconv"
 	"strings" // New import
@@ -16,10 +19,16 @@ import (
 // Retrieve the "id" URL parameter from the current request context, then convert it to
 // an integer and return it. If the operation isn't successful, return 0 and an error.
 func (app *application) readIDParam(r *http.Request) (int64, error) {
+	return app.readNamedIDParam(r, "id")
+}
+
+// The readNamedIDParam() helper works like readIDParam() but for routes with more than
+// one ID in them, like "/v1/gifts/:id/images/:image_id".
+func (app *application) readNamedIDParam(r *http.Request, name string) (int64, error) {
 	params := httprouter.ParamsFromContext(r.Context())
-	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	id, err := strconv.ParseInt(params.ByName(name), 10, 64)
 	if err != nil || id < 1 {
-		return 0, errors.New("invalid id parameter")
+		return 0, fmt.Errorf("invalid %s parameter", name)
 	}
 	return id, nil
 }
@@ -153,6 +162,28 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
+// The readAmount() helper reads a decimal amount of money like "12.50" from the query
+// string and converts it to minor units of the given currency. If no matching key
+// could be found it returns 0, and if the value isn't a valid amount for the currency
+// it records an error message in the provided Validator instance.
+func (app *application) readAmount(qs url.Values, key string, currency string, v *validator.Validator) int64 {
+	s := qs.Get(key)
+	if s == "" {
+		return 0
+	}
+	exponent, ok := data.CurrencyExponents[currency]
+	if !ok {
+		// The currency itself is reported as invalid by ValidateGiftQuery().
+		return 0
+	}
+	amount, err := data.ParseAmount(s, exponent)
+	if err != nil {
+		v.AddError(key, fmt.Sprintf("must be a decimal amount with at most %d decimal places", exponent))
+		return 0
+	}
+	return amount
+}
+
 func (app *application) background(fn func()) {
 	// Increment the WaitGroup counter.
 	app.wg.Add(1)
@@ -168,3 +199,48 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// The clientIP() helper returns the IP address of the client that made the request.
+// When the request comes through one of the trusted proxies, that's the right-most
+// address in the X-Forwarded-For header which isn't a trusted proxy itself. Anything
+// to the left of it could have been made up by the client.
+func (app *application) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !app.trustedProxy(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		addr, err := netip.ParseAddr(hop)
+		if err != nil {
+			// We can't tell where a malformed entry came from, so stop at the last
+			// proxy we trust.
+			return ip
+		}
+		hop = addr.Unmap().String()
+		if !app.trustedProxy(hop) {
+			return hop
+		}
+		ip = hop
+	}
+	return ip
+}
+
+// The trustedProxy() helper reports whether the IP address belongs to one of the
+// reverse proxies given with the -trusted-proxies flag.
+func (app *application) trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range app.config.proxies.trusted {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // Register the GIF decoder with image.Decode().
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"personalized_gifts.sanzhar.net/internal/data"
+	"personalized_gifts.sanzhar.net/internal/thumbnail"
+	"personalized_gifts.sanzhar.net/internal/validator"
+)
+
+// Refuse to decode images with more pixels than this, whatever their file size. A
+// small, highly compressed PNG can otherwise expand to gigabytes in memory.
+const maxImagePixels = 40_000_000
+
+// The giftStoragePrefix() helper returns the storage prefix that all of a gift's
+// image files are kept under.
+func giftStoragePrefix(giftID int64) string {
+	return fmt.Sprintf("gifts/%d/", giftID)
+}
+
+// The setImageURLs() helper fills in the public URLs of the original file and each
+// thumbnail for the given images.
+func (app *application) setImageURLs(images ...*data.GiftImage) {
+	for _, img := range images {
+		img.URL = app.storage.URL(img.OriginalKey())
+		img.Thumbnails = make(map[string]string, len(thumbnail.Sizes))
+		for size := range thumbnail.Sizes {
+			img.Thumbnails[size] = app.storage.URL(img.ThumbnailKey(size))
+		}
+	}
+}
+
+// The attachImages() helper loads the images for the given gifts with a single query
+// and adds them (with their URLs) to each gift.
+func (app *application) attachImages(gifts ...*data.Gift) error {
+	if len(gifts) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(gifts))
+	for i, gift := range gifts {
+		ids[i] = gift.ID
+	}
+	images, err := app.models.Images.GetAllForGifts(ids)
+	if err != nil {
+		return err
+	}
+	for _, gift := range gifts {
+		gift.Images = images[gift.ID]
+		app.setImageURLs(gift.Images...)
+	}
+	return nil
+}
+
+func (app *application) uploadGiftImageHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	_, err = app.models.Gifts.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Limit the whole request body, leaving a little room on top of the image itself
+	// for the multipart boundaries and headers.
+	maxBytes := app.config.images.maxBytes
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+64*1024)
+	err = r.ParseMultipartForm(maxBytes)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesError):
+			app.badRequestResponse(w, r, fmt.Errorf("body must not be larger than %d bytes", maxBytes))
+		default:
+			app.badRequestResponse(w, r, errors.New("body must be a valid multipart form"))
+		}
+		return
+	}
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		v := validator.New()
+		v.AddError("image", "must be provided")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	defer file.Close()
+	content, err := io.ReadAll(io.LimitReader(file, maxBytes+1))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Don't trust the Content-Type sent by the client; sniff it from the file
+	// contents instead, then make sure the image actually decodes.
+	contentType := http.DetectContentType(content)
+	v := validator.New()
+	v.Check(int64(len(content)) <= maxBytes, "image", fmt.Sprintf("must not be larger than %d bytes", maxBytes))
+	_, supported := data.ImageContentTypes[contentType]
+	v.Check(supported, "image", "must be a JPEG, PNG or GIF image")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil || config.Width*config.Height > maxImagePixels {
+		v.AddError("image", "must be a valid image of at most 40 megapixels")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	src, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		v.AddError("image", "must be a valid image")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Store every file for the image under a random prefix, so that re-uploading
+	// never overwrites (or serves a cached copy of) an older image.
+	randomBytes := make([]byte, 8)
+	_, err = rand.Read(randomBytes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	img := &data.GiftImage{
+		GiftID:        id,
+		StoragePrefix: giftStoragePrefix(id) + hex.EncodeToString(randomBytes),
+		ContentType:   contentType,
+	}
+	err = app.storeImage(img, content, src)
+	if err != nil {
+		app.storage.Delete(img.StoragePrefix)
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.Images.Insert(img)
+	if err != nil {
+		app.storage.Delete(img.StoragePrefix)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.setImageURLs(img)
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/gifts/%d/images/%d", id, img.ID))
+	err = app.writeJSON(w, http.StatusCreated, envelope{"image": img}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The storeImage() helper saves the original upload and generates a thumbnail in each
+// of the fixed sizes.
+func (app *application) storeImage(img *data.GiftImage, content []byte, src image.Image) error {
+	err := app.storage.Put(img.OriginalKey(), bytes.NewReader(content), img.ContentType)
+	if err != nil {
+		return err
+	}
+	for size, maxSize := range thumbnail.Sizes {
+		var buf bytes.Buffer
+		thumb := thumbnail.Resize(src, maxSize)
+		contentType := "image/png"
+		if img.ContentType == "image/jpeg" {
+			contentType = "image/jpeg"
+			err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+		} else {
+			err = png.Encode(&buf, thumb)
+		}
+		if err != nil {
+			return err
+		}
+		err = app.storage.Put(img.ThumbnailKey(size), &buf, contentType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (app *application) listGiftImagesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	gift, err := app.models.Gifts.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.attachImages(gift)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	images := gift.Images
+	if images == nil {
+		images = []*data.GiftImage{}
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"images": images}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateGiftImageHandler(w http.ResponseWriter, r *http.Request) {
+	giftID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	id, err := app.readNamedIDParam(r, "image_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	img, err := app.models.Images.Get(giftID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	var input struct {
+		Position *int32 `json:"position"`
+		Primary  *bool  `json:"primary"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if input.Position != nil {
+		img.Position = *input.Position
+	}
+	if input.Primary != nil {
+		// A gift with images always has a primary one, so the only way to change it
+		// is to make a different image primary.
+		v.Check(*input.Primary || !img.Primary, "primary", "make another image primary instead")
+		img.Primary = *input.Primary
+	}
+	if data.ValidateGiftImage(v, img); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Images.Update(img)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.setImageURLs(img)
+	err = app.writeJSON(w, http.StatusOK, envelope{"image": img}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteGiftImageHandler(w http.ResponseWriter, r *http.Request) {
+	giftID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	id, err := app.readNamedIDParam(r, "image_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	img, err := app.models.Images.Get(giftID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.models.Images.Delete(giftID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// The database row is gone, so a failure to remove the files only leaves some
+	// orphaned files behind. Log it rather than failing the request.
+	err = app.storage.Delete(img.StoragePrefix)
+	if err != nil {
+		app.logError(r, err)
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "image successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
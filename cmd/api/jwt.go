@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+
+	"personalized_gifts.sanzhar.net/internal/data"
+	"personalized_gifts.sanzhar.net/internal/jwt"
+)
+
+// The denylist holds the active JWT revocations in memory, so that checking a token
+// doesn't need a database query. Revocations made by other API servers reach this one
+// as notifications, and it is also reloaded from the jwt_denylist table in the
+// background.
+type denylist struct {
+	mu    sync.RWMutex
+	jtis  map[string]bool
+	users map[int64]time.Time
+}
+
+func newDenylist() *denylist {
+	return &denylist{jtis: make(map[string]bool), users: make(map[int64]time.Time)}
+}
+
+// add records a revocation in memory.
+func (d *denylist) add(revocation *data.Revocation) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.addLocked(revocation)
+}
+
+func (d *denylist) addLocked(revocation *data.Revocation) {
+	if revocation.JTI != "" {
+		d.jtis[revocation.JTI] = true
+		return
+	}
+	if revocation.CreatedAt.After(d.users[revocation.UserID]) {
+		d.users[revocation.UserID] = revocation.CreatedAt
+	}
+}
+
+// replace swaps the contents of the denylist for the given revocations.
+func (d *denylist) replace(revocations []*data.Revocation) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.jtis = make(map[string]bool)
+	d.users = make(map[int64]time.Time)
+	for _, revocation := range revocations {
+		d.addLocked(revocation)
+	}
+}
+
+// revoked reports whether a token has been revoked, either by itself or because all
+// of its user's tokens issued up to some time have been.
+func (d *denylist) revoked(claims *jwt.Claims, userID int64) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.jtis[claims.ID] {
+		return true
+	}
+	revokedAt, ok := d.users[userID]
+	return ok && claims.IssuedAt < unixSeconds(revokedAt)
+}
+
+// unixSeconds returns t as a Unix time in seconds, with microsecond precision to match
+// the database.
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixMicro()) / 1e6
+}
+
+// syncDenylist reloads the denylist from the database every interval, and clears out
+// revocations which are no longer needed. Revocations made by other API servers
+// normally arrive straight away through listenForChanges(), so the reload only
+// catches any which were missed. It runs for the lifetime of the process.
+func (app *application) syncDenylist(interval time.Duration) {
+	for {
+		app.reloadDenylist()
+		err := app.models.Denylist.DeleteExpired()
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// reloadDenylist replaces the denylist with the active revocations in the database.
+// It does nothing when JWT mode is disabled.
+func (app *application) reloadDenylist() {
+	if app.jwt == nil {
+		return
+	}
+	revocations, err := app.models.Denylist.GetAllActive()
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+	app.denylist.replace(revocations)
+}
+
+// The issueAccessToken() helper returns the access token to give to a client. When
+// JWT mode is disabled that is just the database token. Otherwise it is a JWT for the
+// user with the same expiry, linked to the database token's family so that logging
+// out also revokes the session's refresh token.
+func (app *application) issueAccessToken(user *data.User, access *data.Token) (*data.Token, error) {
+	if app.jwt == nil {
+		return access, nil
+	}
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	claims := jwt.Claims{
+		Subject:     strconv.FormatInt(user.ID, 10),
+		ID:          hex.EncodeToString(id),
+		IssuedAt:    unixSeconds(time.Now()),
+		ExpiresAt:   access.Expiry.Unix(),
+		SessionID:   hex.EncodeToString(access.Family),
+		Name:        user.Name,
+		Email:       user.Email,
+		Activated:   user.Activated,
+		Permissions: permissions,
+	}
+	signed, err := app.jwt.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+	return &data.Token{Plaintext: signed, Expiry: access.Expiry}, nil
+}
+
+// The revokeJWT() helper adds a single JWT to the denylist until it expires.
+func (app *application) revokeJWT(userID int64, claims *jwt.Claims) error {
+	revocation := &data.Revocation{UserID: userID, JTI: claims.ID, CreatedAt: time.Now(), Expiry: time.Unix(claims.ExpiresAt, 0)}
+	err := app.models.Denylist.Insert(revocation)
+	if err != nil {
+		return err
+	}
+	app.denylist.add(revocation)
+	return nil
+}
+
+// The revokeAllJWTs() helper denies every JWT issued to the users so far. Because JWTs
+// live no longer than the access token TTL, the revocations can expire after that.
+// The revocation time comes from our clock rather than the database's, as that is the
+// clock the tokens' issued at times come from. It does nothing when JWT mode is
+// disabled.
+func (app *application) revokeAllJWTs(userIDs ...int64) error {
+	if app.jwt == nil {
+		return nil
+	}
+	for _, userID := range userIDs {
+		now := time.Now()
+		revocation := &data.Revocation{UserID: userID, CreatedAt: now, Expiry: now.Add(app.config.tokens.accessTTL)}
+		err := app.models.Denylist.Insert(revocation)
+		if err != nil {
+			return err
+		}
+		app.denylist.add(revocation)
+	}
+	return nil
+}
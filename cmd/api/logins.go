@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"personalized_gifts.sanzhar.net/internal/data"
+	"time"
+)
+
+// The checkLoginAllowed() helper looks at the recent failed logins for the email
+// address and the client's IP address, and sends a 423 Locked or 429 Too Many Requests
+// response if this attempt isn't allowed. Otherwise the attempt is recorded as a
+// failure straight away, so that concurrent attempts count it, and it's cleared if the
+// login succeeds. It returns the login status for recordLoginFailure(), or nil if a
+// response has been sent.
+//
+// Failures for an email address are counted whether or not it belongs to a user, so
+// that the responses don't give away which emails are registered.
+func (app *application) checkLoginAllowed(w http.ResponseWriter, r *http.Request, email string) *data.LoginStatus {
+	now := time.Now()
+	status, err := app.models.Logins.RecordAttempt(email, app.clientIP(r), now.Add(-app.config.login.window))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil
+	}
+	if status.LockedUntil != nil {
+		app.accountLockedResponse(w, r, status.LockedUntil.Sub(now))
+		return nil
+	}
+	// Limit the failures from a single IP address across all emails, which stops one
+	// client from trying a common password against lots of accounts.
+	if app.config.login.ipMaxFailures > 0 && status.IPFailures >= app.config.login.ipMaxFailures {
+		app.refuseLoginAttempt(w, r, status, status.FirstIPFailure.Add(app.config.login.window).Sub(now))
+		return nil
+	}
+	// Once an email has had a few failures, make the client wait before each new
+	// attempt, doubling the wait every time. This slows down guessing even when the
+	// attempts come from lots of different IP addresses.
+	if wait := app.loginBackoff(status.EmailFailures); now.Before(status.LastEmailFailure.Add(wait)) {
+		app.refuseLoginAttempt(w, r, status, status.LastEmailFailure.Add(wait).Sub(now))
+		return nil
+	}
+	return status
+}
+
+// The refuseLoginAttempt() helper throttles an attempt which has already been
+// recorded. Attempts which we refuse to make don't count as failures.
+func (app *application) refuseLoginAttempt(w http.ResponseWriter, r *http.Request, status *data.LoginStatus, retryAfter time.Duration) {
+	err := app.models.Logins.DeleteAttempt(status.AttemptID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.loginThrottledResponse(w, r, retryAfter)
+}
+
+// The loginBackoff() helper returns how long a client must wait after the last failed
+// login for an email address which has had the given number of failures.
+func (app *application) loginBackoff(failures int) time.Duration {
+	excess := failures - app.config.login.backoffAfter
+	if excess < 0 {
+		return 0
+	}
+	wait := time.Second
+	for i := 0; i < excess && wait < app.config.login.backoffMax; i++ {
+		wait *= 2
+	}
+	if wait > app.config.login.backoffMax {
+		wait = app.config.login.backoffMax
+	}
+	return wait
+}
+
+// The recordLoginFailure() helper sends the response for a failed login, which
+// checkLoginAllowed() has already recorded. If the email address has now had too many
+// failures, it is locked and, when it belongs to a user, we email them to let them
+// know. The user is nil for unknown email addresses.
+func (app *application) recordLoginFailure(w http.ResponseWriter, r *http.Request, email string, status *data.LoginStatus, user *data.User) {
+	now := time.Now()
+	if app.config.login.lockoutAfter <= 0 || status.EmailFailures+1 < app.config.login.lockoutAfter {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+	lockedUntil := now.Add(app.config.login.lockoutDuration)
+	err := app.models.Logins.Lock(email, lockedUntil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.logger.PrintInfo("login locked after too many failures", map[string]string{
+		"email": email,
+		"ip":    app.clientIP(r),
+	})
+	if user != nil {
+		ip := app.clientIP(r)
+		app.background(func() {
+			data := map[string]interface{}{
+				"lockedUntil": lockedUntil.UTC().Format(time.RFC1123),
+				"ip":          ip,
+			}
+			err := app.mailer.Send(user.Email, "account_locked.tmpl", data)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+	app.accountLockedResponse(w, r, lockedUntil.Sub(now))
+}
@@ -3,12 +3,21 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"expvar"
 	"flag"
+	"fmt"
 	_ "github.com/lib/pq"
+	"net/netip"
 	"os"
 	"personalized_gifts.sanzhar.net/internal/data"
 	"personalized_gifts.sanzhar.net/internal/jsonlog"
+	"personalized_gifts.sanzhar.net/internal/jwt"
 	"personalized_gifts.sanzhar.net/internal/mailer"
+	"personalized_gifts.sanzhar.net/internal/oidc"
+	"personalized_gifts.sanzhar.net/internal/ratelimit"
+	"personalized_gifts.sanzhar.net/internal/storage"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -16,6 +25,8 @@ import (
 
 const version = "1.0.0"
 
+var searchConfigRX = regexp.MustCompile(`^[a-z_]+$`)
+
 type config struct {
 	port int
 	env  string
@@ -27,6 +38,7 @@ type config struct {
 	}
 	limiter struct {
 		enabled bool
+		backend string
 		rps     float64
 		burst   int
 	}
@@ -40,14 +52,74 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	proxies struct {
+		trusted []netip.Prefix
+	}
+	search struct {
+		config string
+	}
+	storage struct {
+		dir     string
+		baseURL string
+	}
+	images struct {
+		maxBytes int64
+	}
+	tokens struct {
+		accessTTL  time.Duration
+		refreshTTL time.Duration
+	}
+	permissions struct {
+		cacheTTL time.Duration
+	}
+	roles struct {
+		defaultRole string
+	}
+	login struct {
+		window          time.Duration
+		backoffAfter    int
+		backoffMax      time.Duration
+		lockoutAfter    int
+		lockoutDuration time.Duration
+		ipMaxFailures   int
+	}
+	mfa struct {
+		issuer              string
+		requiredPermissions []string
+	}
+	oidc struct {
+		providers []oidc.Config
+		cacheTTL  time.Duration
+	}
+	jwt struct {
+		enabled          bool
+		keys             []jwtKeyConfig
+		signingKey       string
+		issuer           string
+		denylistInterval time.Duration
+	}
+}
+
+// jwtKeyConfig describes a JWT key given with the -jwt-key flag.
+type jwtKeyConfig struct {
+	id        string
+	algorithm string
+	path      string
 }
 
 type application struct {
-	config config
-	logger *jsonlog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	config  config
+	logger  *jsonlog.Logger
+	models  data.Models
+	mailer  mailer.Mailer
+	storage storage.Storage
+	// jwt is nil unless JWT mode is enabled.
+	jwt      *jwt.KeySet
+	denylist *denylist
+	limiter  ratelimit.Limiter
+	// oidcProviders holds the identity providers that users can sign in with, by name.
+	oidcProviders map[string]*oidc.Provider
+	wg            sync.WaitGroup
 }
 
 func main() {
@@ -59,6 +131,7 @@ func main() {
 	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
 	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	flag.StringVar(&cfg.limiter.backend, "limiter-backend", "memory", "Rate limiter backend (memory|postgres)")
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.StringVar(&cfg.smtp.host, "smtp-host", "sandbox.smtp.mailtrap.io", "SMTP host")
@@ -70,19 +143,129 @@ func main() {
 		cfg.cors.trustedOrigins = strings.Fields(val)
 		return nil
 	})
+	flag.Func("trusted-proxies", "IP addresses and CIDR ranges of reverse proxies whose X-Forwarded-For headers are trusted (space separated)", func(val string) error {
+		for _, field := range strings.Fields(val) {
+			prefix, err := parseTrustedProxy(field)
+			if err != nil {
+				return err
+			}
+			cfg.proxies.trusted = append(cfg.proxies.trusted, prefix)
+		}
+		return nil
+	})
+	flag.StringVar(&cfg.search.config, "search-config", "english", "PostgreSQL text search configuration for gift searches")
+	flag.StringVar(&cfg.storage.dir, "storage-dir", "./uploads", "Directory for uploaded files")
+	flag.StringVar(&cfg.storage.baseURL, "storage-base-url", "/v1/images", "Base URL that uploaded files are served from")
+	flag.Int64Var(&cfg.images.maxBytes, "images-max-bytes", 5*1024*1024, "Maximum size of an uploaded image in bytes")
+	flag.DurationVar(&cfg.tokens.accessTTL, "access-token-ttl", 15*time.Minute, "Lifetime of authentication (access) tokens")
+	flag.DurationVar(&cfg.tokens.refreshTTL, "refresh-token-ttl", 30*24*time.Hour, "Lifetime of refresh tokens")
+	flag.DurationVar(&cfg.permissions.cacheTTL, "permissions-cache-ttl", time.Minute, "How long to cache user permissions in memory (0 to disable)")
+	flag.StringVar(&cfg.roles.defaultRole, "default-role", "customer", "Role given to newly registered users (empty for none)")
+	flag.DurationVar(&cfg.login.window, "login-failure-window", 15*time.Minute, "How long failed logins count towards backoff and lockout")
+	flag.IntVar(&cfg.login.backoffAfter, "login-backoff-after", 3, "Failed logins for an email before each new attempt must wait")
+	flag.DurationVar(&cfg.login.backoffMax, "login-backoff-max", time.Minute, "Longest wait between login attempts for an email")
+	flag.IntVar(&cfg.login.lockoutAfter, "login-lockout-after", 10, "Failed logins for an email before it is locked (0 to disable)")
+	flag.DurationVar(&cfg.login.lockoutDuration, "login-lockout-duration", 30*time.Minute, "How long an email stays locked")
+	flag.IntVar(&cfg.login.ipMaxFailures, "login-ip-max-failures", 100, "Failed logins from one IP address before it is throttled (0 to disable)")
+	flag.StringVar(&cfg.mfa.issuer, "mfa-issuer", "PersonalizedGifts", "Issuer name shown in authenticator apps")
+	flag.Func("mfa-required-permissions", "Permission codes whose users must use two-factor authentication (space separated)", func(val string) error {
+		cfg.mfa.requiredPermissions = strings.Fields(val)
+		return nil
+	})
+	flag.Func("oidc-provider", "OpenID Connect provider as name=...,issuer=...,client-id=...,client-secret=...,redirect-url=... (can be repeated)", func(val string) error {
+		provider, err := parseOIDCProvider(val)
+		if err != nil {
+			return err
+		}
+		cfg.oidc.providers = append(cfg.oidc.providers, provider)
+		return nil
+	})
+	flag.DurationVar(&cfg.oidc.cacheTTL, "oidc-cache-ttl", time.Hour, "How long to cache identity provider discovery documents and signing keys")
+	// In JWT mode access tokens are signed JWTs which carry the user's permissions, so
+	// authenticating a request needs no database queries. Changes to permissions only
+	// take effect when the access token is refreshed.
+	flag.BoolVar(&cfg.jwt.enabled, "jwt-enabled", false, "Issue signed JWTs as access tokens")
+	flag.Func("jwt-key", "JWT key as id:algorithm:path, where algorithm is HS256 or EdDSA (can be repeated)", func(val string) error {
+		parts := strings.SplitN(val, ":", 3)
+		if len(parts) != 3 {
+			return errors.New("must be in the format id:algorithm:path")
+		}
+		cfg.jwt.keys = append(cfg.jwt.keys, jwtKeyConfig{id: parts[0], algorithm: parts[1], path: parts[2]})
+		return nil
+	})
+	flag.StringVar(&cfg.jwt.signingKey, "jwt-signing-key", "", "ID of the JWT key to sign new tokens with (defaults to the first key)")
+	flag.StringVar(&cfg.jwt.issuer, "jwt-issuer", "personalized-gifts", "JWT issuer claim")
+	flag.DurationVar(&cfg.jwt.denylistInterval, "jwt-denylist-interval", 30*time.Second, "How often to reload the JWT denylist from the database")
 	flag.Parse()
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
+	// The text search configuration is interpolated into SQL queries, so only accept
+	// plain identifiers like "english" or "russian".
+	if !searchConfigRX.MatchString(cfg.search.config) {
+		logger.PrintFatal(errors.New("invalid -search-config value"), nil)
+	}
+	if cfg.tokens.accessTTL <= 0 || cfg.tokens.refreshTTL < cfg.tokens.accessTTL {
+		logger.PrintFatal(errors.New("-refresh-token-ttl must be at least -access-token-ttl, and both must be positive"), nil)
+	}
 	db, err := openDB(cfg)
 	if err != nil {
 		logger.PrintFatal(err, nil)
 	}
 	defer db.Close()
 	logger.PrintInfo("database connection pool established", nil)
+	store, err := storage.NewLocal(cfg.storage.dir, cfg.storage.baseURL)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	models := data.NewModels(db)
+	models.Gifts.SearchConfig = cfg.search.config
+	if cfg.permissions.cacheTTL > 0 {
+		models.Permissions.Cache = data.NewPermissionCache(cfg.permissions.cacheTTL)
+		models.Roles.Cache = models.Permissions.Cache
+		// Publish the cache counters, so they can be monitored via GET /debug/vars.
+		expvar.Publish("permission_cache", expvar.Func(func() interface{} {
+			return models.Permissions.Cache.Stats()
+		}))
+	}
+	// Check that the default role exists now, rather than when the first user signs up.
+	if cfg.roles.defaultRole != "" {
+		_, err = models.Roles.GetByName(cfg.roles.defaultRole)
+		if err != nil {
+			logger.PrintFatal(fmt.Errorf("default role %q: %w", cfg.roles.defaultRole, err), nil)
+		}
+	}
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:   cfg,
+		logger:   logger,
+		models:   models,
+		mailer:   mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		storage:  store,
+		denylist: newDenylist(),
+	}
+	switch cfg.limiter.backend {
+	case "memory":
+		app.limiter = ratelimit.NewMemory(cfg.limiter.rps, cfg.limiter.burst)
+	case "postgres":
+		// Share the limits with every other API server using the same database.
+		app.limiter = ratelimit.NewPostgres(db, cfg.limiter.rps, cfg.limiter.burst)
+	default:
+		logger.PrintFatal(fmt.Errorf("invalid -limiter-backend %q", cfg.limiter.backend), nil)
+	}
+	app.oidcProviders = make(map[string]*oidc.Provider)
+	for _, provider := range cfg.oidc.providers {
+		if _, exists := app.oidcProviders[provider.Name]; exists {
+			logger.PrintFatal(fmt.Errorf("duplicate -oidc-provider %q", provider.Name), nil)
+		}
+		app.oidcProviders[provider.Name] = oidc.NewProvider(provider, cfg.oidc.cacheTTL)
+	}
+	if cfg.jwt.enabled {
+		app.jwt, err = loadKeySet(cfg)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		go app.syncDenylist(cfg.jwt.denylistInterval)
+	}
+	if models.Permissions.Cache != nil || app.jwt != nil {
+		go app.listenForChanges()
 	}
 	err = app.serve()
 	if err != nil {
@@ -90,6 +273,81 @@ func main() {
 	}
 }
 
+// oidcProviderNameRX matches the names that identity providers can have, since they
+// appear in our URLs.
+var oidcProviderNameRX = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// parseTrustedProxy() parses an entry of the -trusted-proxies flag, which is either a
+// CIDR range or a single IP address.
+func parseTrustedProxy(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// parseOIDCProvider() parses the value of an -oidc-provider flag, which is a comma
+// separated list of key=value settings. The scopes setting is space separated, and
+// defaults to "openid email profile".
+func parseOIDCProvider(val string) (oidc.Config, error) {
+	var provider oidc.Config
+	for _, setting := range strings.Split(val, ",") {
+		key, value, ok := strings.Cut(setting, "=")
+		if !ok {
+			return provider, fmt.Errorf("invalid setting %q", setting)
+		}
+		switch key {
+		case "name":
+			provider.Name = value
+		case "issuer":
+			provider.Issuer = value
+		case "client-id":
+			provider.ClientID = value
+		case "client-secret":
+			provider.ClientSecret = value
+		case "redirect-url":
+			provider.RedirectURL = value
+		case "scopes":
+			provider.Scopes = strings.Fields(value)
+		default:
+			return provider, fmt.Errorf("unknown setting %q", key)
+		}
+	}
+	if !oidcProviderNameRX.MatchString(provider.Name) {
+		return provider, errors.New("name must only contain lowercase letters, digits and hyphens")
+	}
+	if provider.Issuer == "" || provider.ClientID == "" || provider.RedirectURL == "" {
+		return provider, errors.New("issuer, client-id and redirect-url must be provided")
+	}
+	return provider, nil
+}
+
+// loadKeySet() loads the keys given by the -jwt-key flags.
+func loadKeySet(cfg config) (*jwt.KeySet, error) {
+	if len(cfg.jwt.keys) == 0 {
+		return nil, errors.New("-jwt-enabled requires at least one -jwt-key")
+	}
+	keys := make([]*jwt.Key, len(cfg.jwt.keys))
+	for i, k := range cfg.jwt.keys {
+		key, err := jwt.LoadKey(k.id, k.algorithm, k.path)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+	}
+	signingKey := cfg.jwt.signingKey
+	if signingKey == "" {
+		signingKey = keys[0].ID
+	}
+	return jwt.NewKeySet(cfg.jwt.issuer, signingKey, keys...)
+}
+
 func openDB(cfg config) (*sql.DB, error) {
 	db, err := sql.Open("postgres", cfg.db.dsn)
 	if err != nil {
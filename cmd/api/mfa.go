@@ -0,0 +1,490 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"personalized_gifts.sanzhar.net/internal/data"
+	"personalized_gifts.sanzhar.net/internal/totp"
+	"personalized_gifts.sanzhar.net/internal/validator"
+	"time"
+)
+
+const (
+	// mfaChallengeTTL is how long a client has to complete the second step of a login.
+	mfaChallengeTTL = 5 * time.Minute
+	// totpSkew is how many time steps either side of the current one we accept codes
+	// from.
+	totpSkew = 1
+)
+
+// The mfaRequired() helper reports whether the user must use two-factor
+// authentication, because they have one of the permissions configured with the
+// -mfa-required-permissions flag.
+func (app *application) mfaRequired(userID int64) (bool, error) {
+	if len(app.config.mfa.requiredPermissions) == 0 {
+		return false, nil
+	}
+	permissions, err := app.models.Permissions.GetAllForUser(userID)
+	if err != nil {
+		return false, err
+	}
+	for _, code := range app.config.mfa.requiredPermissions {
+		if permissions.Include(code) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// The createMFAChallenge() helper sends the response to a correct password for a user
+// who needs a second step to log in. The challenge token lets the client complete the
+// login with a code, or enroll first if enrollmentRequired is true.
+func (app *application) createMFAChallenge(w http.ResponseWriter, r *http.Request, user *data.User, enrollmentRequired bool) {
+	// Only the most recent challenge can be used.
+	err := app.models.Tokens.DeleteAllForUser(data.ScopeMFAChallenge, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	token, err := app.models.Tokens.New(user.ID, mfaChallengeTTL, data.ScopeMFAChallenge)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	env := envelope{"mfa_challenge_token": token, "mfa_enrollment_required": enrollmentRequired}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The getMFAChallengeUser() helper checks the validator and the challenge token from a
+// request, and returns the user that the token belongs to. If anything is wrong, it
+// sends an error response and returns nil.
+func (app *application) getMFAChallengeUser(w http.ResponseWriter, r *http.Request, v *validator.Validator, tokenPlaintext string) *data.User {
+	v.Check(tokenPlaintext != "", "mfa_challenge_token", "must be provided")
+	v.Check(len(tokenPlaintext) == 26, "mfa_challenge_token", "must be 26 bytes long")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil
+	}
+	user, err := app.models.Users.GetForToken(data.ScopeMFAChallenge, tokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("mfa_challenge_token", "invalid or expired two-factor challenge token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	if user.Disabled {
+		app.disabledAccountResponse(w, r)
+		return nil
+	}
+	return user
+}
+
+// The verifyMFACode() helper checks a TOTP code, or a recovery code if one is given,
+// for a user with TOTP enabled. Each code only works once.
+func (app *application) verifyMFACode(user *data.User, setup *data.TOTP, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		return app.models.MFA.UseRecoveryCode(user.ID, recoveryCode)
+	}
+	step, ok := totp.Validate(setup.Secret, code, time.Now(), totpSkew)
+	if !ok {
+		return false, nil
+	}
+	return app.models.MFA.UseTOTPStep(user.ID, step)
+}
+
+// The startTOTPEnrollment() helper generates a new TOTP secret for the user and sends
+// it to the client, both as text and as an otpauth:// URI for a QR code.
+func (app *application) startTOTPEnrollment(w http.ResponseWriter, r *http.Request, user *data.User) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.MFA.SetTOTPSecret(user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTOTPEnabled):
+			app.failedValidationResponse(w, r, map[string]string{"totp": "is already enabled"})
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	env := envelope{"totp": envelope{
+		"secret": totp.EncodeSecret(secret),
+		"uri":    totp.URI(app.config.mfa.issuer, user.Email, secret),
+	}}
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The confirmTOTPEnrollment() helper enables TOTP for the user if the code matches the
+// secret from startTOTPEnrollment(), and returns their new recovery codes. It returns
+// nil codes if the code is wrong.
+func (app *application) confirmTOTPEnrollment(user *data.User, code string) ([]string, error) {
+	setup, err := app.models.MFA.GetTOTP(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if setup.Enabled {
+		return nil, data.ErrTOTPEnabled
+	}
+	if setup.Secret == nil {
+		return nil, data.ErrTOTPNotEnrolled
+	}
+	step, ok := totp.Validate(setup.Secret, code, time.Now(), totpSkew)
+	if !ok {
+		return nil, nil
+	}
+	recoveryCodes, err := data.GenerateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	err = app.models.MFA.EnableTOTP(user.ID, step, recoveryCodes)
+	if err != nil {
+		return nil, err
+	}
+	return recoveryCodes, nil
+}
+
+// The enrollmentErrorResponse() helper sends the response for an error from
+// confirmTOTPEnrollment().
+func (app *application) enrollmentErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, data.ErrTOTPEnabled):
+		app.failedValidationResponse(w, r, map[string]string{"totp": "is already enabled"})
+	case errors.Is(err, data.ErrTOTPNotEnrolled):
+		app.failedValidationResponse(w, r, map[string]string{"totp": "enrollment hasn't been started"})
+	default:
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Complete a login for a user with two-factor authentication, by exchanging the
+// challenge token from the password step and a TOTP code (or a recovery code) for the
+// usual authentication and refresh tokens. Wrong codes count as failed logins, so they
+// are throttled in the same way as wrong passwords.
+func (app *application) createMFAAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"mfa_challenge_token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(input.Code != "" || input.RecoveryCode != "", "code", "must be provided")
+	v.Check(input.Code == "" || input.RecoveryCode == "", "code", "must not be provided with a recovery code")
+	user := app.getMFAChallengeUser(w, r, v, input.TokenPlaintext)
+	if user == nil {
+		return
+	}
+	setup, err := app.models.MFA.GetTOTP(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !setup.Enabled {
+		v.AddError("mfa_challenge_token", "must be used to enroll in two-factor authentication first")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	status := app.checkLoginAllowed(w, r, user.Email)
+	if status == nil {
+		return
+	}
+	ok, err := app.verifyMFACode(user, setup, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		app.recordLoginFailure(w, r, user.Email, status, user)
+		return
+	}
+	app.completeMFAChallenge(w, r, user, envelope{})
+}
+
+// The completeMFAChallenge() helper finishes a login once the second step has
+// succeeded, using up the challenge token.
+func (app *application) completeMFAChallenge(w http.ResponseWriter, r *http.Request, user *data.User, env envelope) {
+	err := app.models.Tokens.DeleteAllForUser(data.ScopeMFAChallenge, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.Logins.Clear(user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.writeAuthenticationTokens(w, r, user, true, env)
+}
+
+// Start TOTP enrollment during a login, for a user who must use two-factor
+// authentication but hasn't set it up yet.
+func (app *application) startChallengeEnrollmentHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"mfa_challenge_token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	user := app.getMFAChallengeUser(w, r, validator.New(), input.TokenPlaintext)
+	if user == nil {
+		return
+	}
+	app.startTOTPEnrollment(w, r, user)
+}
+
+// Confirm TOTP enrollment during a login. This completes the login as well, so the
+// response has the authentication and refresh tokens along with the recovery codes.
+func (app *application) confirmChallengeEnrollmentHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"mfa_challenge_token"`
+		Code           string `json:"code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(input.Code != "", "code", "must be provided")
+	user := app.getMFAChallengeUser(w, r, v, input.TokenPlaintext)
+	if user == nil {
+		return
+	}
+	status := app.checkLoginAllowed(w, r, user.Email)
+	if status == nil {
+		return
+	}
+	recoveryCodes, err := app.confirmTOTPEnrollment(user, input.Code)
+	if err != nil {
+		app.enrollmentErrorResponse(w, r, err)
+		return
+	}
+	if recoveryCodes == nil {
+		app.recordLoginFailure(w, r, user.Email, status, user)
+		return
+	}
+	app.completeMFAChallenge(w, r, user, envelope{"recovery_codes": recoveryCodes})
+}
+
+// Show the current user's two-factor authentication settings.
+func (app *application) showMFAHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	setup, err := app.models.MFA.GetTOTP(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	required, err := app.mfaRequired(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	remaining, err := app.models.MFA.CountRecoveryCodes(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	env := envelope{"mfa": envelope{
+		"totp_enabled":             setup.Enabled,
+		"required":                 required,
+		"recovery_codes_remaining": remaining,
+	}}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) startTOTPEnrollmentHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getCurrentUser(w, r)
+	if user == nil {
+		return
+	}
+	app.startTOTPEnrollment(w, r, user)
+}
+
+// Confirm TOTP enrollment with a code from the authenticator app, which shows that the
+// app has the secret. The response has the user's recovery codes, which are never
+// shown again.
+func (app *application) confirmTOTPEnrollmentHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getCurrentUser(w, r)
+	if user == nil {
+		return
+	}
+	var input struct {
+		Code string `json:"code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if v.Check(input.Code != "", "code", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	recoveryCodes, err := app.confirmTOTPEnrollment(user, input.Code)
+	if err != nil {
+		app.enrollmentErrorResponse(w, r, err)
+		return
+	}
+	if recoveryCodes == nil {
+		v.AddError("code", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": recoveryCodes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Turn off TOTP for the current user, which needs their password and a code. Users who
+// are required to use two-factor authentication can't turn it off.
+func (app *application) disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getCurrentUser(w, r)
+	if user == nil {
+		return
+	}
+	var input struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(input.Password != "", "password", "must be provided")
+	v.Check(input.Code != "" || input.RecoveryCode != "", "code", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	required, err := app.mfaRequired(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if required {
+		app.mfaRequiredResponse(w, r)
+		return
+	}
+	setup, err := app.models.MFA.GetTOTP(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !setup.Enabled {
+		v.AddError("totp", "isn't enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !match {
+		v.AddError("password", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	ok, err := app.verifyMFACode(user, setup, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		v.AddError("code", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.MFA.DisableTOTP(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication was successfully disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Replace the current user's recovery codes, for example when they have used most of
+// them. This needs a code from their authenticator app.
+func (app *application) regenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getCurrentUser(w, r)
+	if user == nil {
+		return
+	}
+	var input struct {
+		Code string `json:"code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if v.Check(input.Code != "", "code", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	setup, err := app.models.MFA.GetTOTP(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !setup.Enabled {
+		v.AddError("totp", "isn't enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	ok, err := app.verifyMFACode(user, setup, input.Code, "")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		v.AddError("code", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	recoveryCodes, err := data.GenerateRecoveryCodes()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.MFA.ReplaceRecoveryCodes(user.ID, recoveryCodes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusCreated, envelope{"recovery_codes": recoveryCodes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -3,14 +3,12 @@ package main
 import (
 	"errors"
 	"fmt"
-	"net"
 	"net/http"
 	"strings"
-	"sync"
 	"time"
 
-	"golang.org/x/time/rate"
 	"personalized_gifts.sanzhar.net/internal/data"
+	"personalized_gifts.sanzhar.net/internal/jwt"
 	"personalized_gifts.sanzhar.net/internal/validator"
 )
 
@@ -40,94 +38,18 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 }
 
 func (app *application) rateLimit(next http.Handler) http.Handler {
-
-	// Define a client struct to hold the rate limiter and last seen time for each client.
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
-	}
-
-	// Declare a mutex and a map to hold the client's IP addresses and rate limiters.
-	var (
-		mu sync.Mutex
-		// clients = make(map[string]*rate.Limiter)
-		// Update the map so the values are pointers to a client struct.
-		clients = make(map[string]*client)
-	)
-
-	// Launch a background goroutine which removes old entries from the clients map once every minute.
-	go func() {
-		for {
-			time.Sleep(time.Minute)
-			// Lock the mutex to prevent any rate limiter checks from happening while the cleanup is taking place.
-			mu.Lock()
-
-			// Loop through all clients. If they haven't been seen within the last three minutes,
-			// delete the corresponding entry from the map.
-			for ip, client := range clients {
-				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
-				}
-			}
-			// Inportantly, unlock the mutex when the cleanup is complete.
-			mu.Unlock()
-		}
-	}()
-
-	// Initialize a new rate limiter which allows an average of
-	// 2 requests per second, with a maximum of 4 requests in a single 'burst'.
-	// limiter := rate.NewLimiter(2, 4)
-
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Only carry out the check if rate limiting is enabled.
 		if app.config.limiter.enabled {
-			// Extract the client's IP address from the request.
-			ip, _, err := net.SplitHostPort(r.RemoteAddr)
+			allowed, err := app.limiter.Allow(r.Context(), app.clientIP(r))
 			if err != nil {
-				app.serverErrorResponse(w, r, err)
-				return
-			}
-
-			// Lock the mutex to prevent tis code from being executed concurrently.
-			mu.Lock()
-
-			// Check to see if the IP address already exists in the map. If it doesn't,
-			// then initialize a new rate limiter adn add the IP address and limiter to the map.
-			if _, found := clients[ip]; !found {
-				// clients[ip] = rate.NewLimiter(2, 4)
-
-				// Create and add a new client struct to the map if it doesn't already exist.
-				// clients[ip] = &client{limiter: rate.NewLimiter(2, 4)}
-
-				// Use the requests-per-second and burst values from the config struct.
-				clients[ip] = &client{
-					limiter: rate.NewLimiter(rate.Limit(app.config.limiter.rps), app.config.limiter.burst)}
-			}
-			// update the last seen time for the client.
-			clients[ip].lastSeen = time.Now()
-
-			// Call the Allow() method on the rate limiter for the current IP address.
-			// If the request isn't allowed, unlock the mutex and send a 429 response, just like befor.
-			if !clients[ip].limiter.Allow() {
-				mu.Unlock()
+				// If the limiter's backend is down, let the request through rather than
+				// taking the whole API down with it, but log the error so it gets noticed.
+				app.logError(r, err)
+			} else if !allowed {
 				app.rateLimitExceededResponse(w, r)
 				return
 			}
-
-			// Very important, unlock the mutex before calling the next handler in the chain.
-			// Notice that we DON'T use defer to unlock the mutex, as that
-			// would mean that the mutex isn't unlocker until all the handlers donwstream of this
-			// middleware have also returned.
-			mu.Unlock()
-
-			// Call limiter.Allow() to see if the request is permitted, and if it's not,
-			// then we call the rateLimitExceededResponse() helper to return a
-			// 429 Too Many Requests response (we will create this helper in a minute).
-			// if !limiter.Allow() {
-			// 	app.rateLimitExceededResponse(w, r)
-			// 	return
-			// }
-
 		}
 		next.ServeHTTP(w, r)
 	})
@@ -157,6 +79,10 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// "Bearer <token>". We try to split this into its constitent parts, and if the header
 		// isn't in the expected format we return a 401 Unauthorized response.
 		headerParts := strings.Split(authorizationHeader, " ")
+		if len(headerParts) == 2 && headerParts[0] == "ApiKey" {
+			app.authenticateAPIKey(w, r, next, headerParts[1])
+			return
+		}
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
 			app.invalidCredentialsResponse(w, r)
 			return
@@ -165,6 +91,31 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// Extract the actual authentication token from the header parts.
 		token := headerParts[1]
 
+		// In JWT mode, verify the token's signature and build the user from its claims,
+		// without touching the database.
+		if app.jwt != nil && jwt.IsToken(token) {
+			claims, err := app.jwt.Verify(token, time.Now())
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+			userID, err := claims.UserID()
+			if err != nil || app.denylist.revoked(claims, userID) {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+			user := &data.User{
+				ID:        userID,
+				Name:      claims.Name,
+				Email:     claims.Email,
+				Activated: claims.Activated,
+			}
+			r = app.contextSetUser(r, user)
+			r = app.contextSetClaims(r, claims)
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		// Validate the token to make sure it is in a sensible format.
 		v := validator.New()
 
@@ -189,14 +140,68 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		// Record that the token has been used, for the session list. This isn't worth
+		// failing the request over, so we only log any error.
+		err = app.models.Tokens.Touch(token)
+		if err != nil {
+			app.logError(r, err)
+		}
+
 		// Call the contextSetUser() helper to add the user information to the request context.
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, token)
 
 		// Call the next handler in the chain.
 		next.ServeHTTP(w, r)
 	})
 }
 
+// The authenticateAPIKey() method authenticates a request made with an API key, in the
+// format "ApiKey <key>". The request is made as the key's owner, but with only the
+// key's permissions.
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, plaintext string) {
+	if !data.IsAPIKey(plaintext) {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+	key, err := app.models.APIKeys.GetByPlaintext(plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	ip := app.clientIP(r)
+	if !key.AllowsIP(ip) {
+		app.logger.PrintInfo("api key used from an address which isn't allowed", map[string]string{
+			"prefix": key.Prefix,
+			"ip":     ip,
+		})
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+	user, err := app.models.Users.Get(key.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if user.Disabled {
+		app.disabledAccountResponse(w, r)
+		return
+	}
+	// Record that the key has been used. As with tokens, we only log any error.
+	err = app.models.APIKeys.Touch(key.ID, ip)
+	if err != nil {
+		app.logError(r, err)
+	}
+	r = app.contextSetUser(r, user)
+	r = app.contextSetAPIKey(r, key)
+	next.ServeHTTP(w, r)
+}
+
 // Create a new requireAuthenticatedUser() middleware to check that a user is not
 // anonymous.
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
@@ -210,6 +215,20 @@ func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.Han
 	})
 }
 
+// The requireUserSession() middleware checks that the request comes from a user who
+// logged in, rather than from a program with one of their API keys. It protects the
+// endpoints for managing the account itself, like its sessions and API keys.
+func (app *application) requireUserSession(next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil {
+			app.apiKeyNotAllowedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+	return app.requireAuthenticatedUser(fn)
+}
+
 // Checks that a user is both authenticated and activated.
 func (app *application) requireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
 	// Rather than returning this http.HandlerFunc we assign it to the variable fn.
@@ -226,14 +245,45 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
+// The userHasPermission() helper reports whether the user making the request has a
+// specific permission code. It is for handlers where the permission changes what the
+// user sees rather than whether they can use the endpoint at all.
+func (app *application) userHasPermission(r *http.Request, code string) (bool, error) {
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() {
+		return false, nil
+	}
+	permissions, err := app.getPermissions(r)
+	if err != nil {
+		return false, err
+	}
+	return permissions.Include(code), nil
+}
+
+// The getPermissions() helper returns the permissions of the user making the request.
+// For requests authenticated with a JWT they come from its claims; otherwise they are
+// read from the database, and limited to the API key's permissions for requests made
+// with one.
+func (app *application) getPermissions(r *http.Request) (data.Permissions, error) {
+	if claims := app.contextGetClaims(r); claims != nil {
+		return data.Permissions(claims.Permissions), nil
+	}
+	permissions, err := app.models.Permissions.GetAllForUser(app.contextGetUser(r).ID)
+	if err != nil {
+		return nil, err
+	}
+	if key := app.contextGetAPIKey(r); key != nil {
+		return key.GrantedPermissions(permissions), nil
+	}
+	return permissions, nil
+}
+
 // Note that the first parameter for the middleware function is the permission code that
 // we require the user to have.
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		// Retrieve the user from the request context.
-		user := app.contextGetUser(r)
 		// Get the slice of permissions for the user.
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissions, err := app.getPermissions(r)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -251,6 +301,69 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 	// Wrap this with the requireActivatedUser() middleware before returning it.
 	return app.requireActivatedUser(fn)
 }
+
+// The requireAnyPermission() middleware is like requirePermission(), but lets the
+// request through if the user has at least one of the permission codes.
+func (app *application) requireAnyPermission(codes []string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		permissions, err := app.getPermissions(r)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		for _, code := range codes {
+			if permissions.Include(code) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		app.notPermittedResponse(w, r)
+	}
+	return app.requireActivatedUser(fn)
+}
+
+// The requireGiftWriter() middleware protects the endpoints which change the gift in
+// the "id" URL parameter. Users with gifts:write:any can change any gift, and users
+// with gifts:write:own can only change the gifts that they created.
+func (app *application) requireGiftWriter(next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		permissions, err := app.getPermissions(r)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if permissions.Include("gifts:write:any") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !permissions.Include("gifts:write:own") {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		id, err := app.readIDParam(r)
+		if err != nil {
+			app.notFoundResponse(w, r)
+			return
+		}
+		owner, err := app.models.Gifts.GetOwner(id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		if owner == nil || *owner != app.contextGetUser(r).ID {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return app.requireActivatedUser(fn)
+}
+
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Origin")
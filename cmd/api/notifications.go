@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"personalized_gifts.sanzhar.net/internal/data"
+)
+
+// listenForChanges applies the changes which API servers broadcast when they update
+// data that every server holds in memory: users' permissions and the JWT denylist.
+// This is what makes a revocation on one server take effect on all of them straight
+// away. It runs for the lifetime of the process.
+func (app *application) listenForChanges() {
+	listener := pq.NewListener(app.config.db.dsn, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+	for _, channel := range []string{data.PermissionsChannel, data.DenylistChannel} {
+		err := listener.Listen(channel)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"channel": channel})
+		}
+	}
+	for notification := range listener.Notify {
+		// A nil notification means that the connection was lost and has been
+		// re-established, so we may have missed some changes. Start again from what
+		// is in the database.
+		if notification == nil {
+			app.invalidatePermissions("")
+			app.reloadDenylist()
+			continue
+		}
+		switch notification.Channel {
+		case data.PermissionsChannel:
+			app.invalidatePermissions(notification.Extra)
+		case data.DenylistChannel:
+			var revocation data.Revocation
+			err := json.Unmarshal([]byte(notification.Extra), &revocation)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+				app.reloadDenylist()
+				continue
+			}
+			if app.jwt != nil {
+				app.denylist.add(&revocation)
+			}
+		}
+	}
+}
+
+// invalidatePermissions drops the cached permissions of the user with the given ID,
+// or of every user if it isn't a valid ID.
+func (app *application) invalidatePermissions(userID string) {
+	cache := app.models.Permissions.Cache
+	if cache == nil {
+		return
+	}
+	id, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		cache.InvalidateAll()
+		return
+	}
+	cache.Invalidate(id)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"personalized_gifts.sanzhar.net/internal/data"
+	"personalized_gifts.sanzhar.net/internal/oidc"
+	"personalized_gifts.sanzhar.net/internal/validator"
+	"strings"
+	"time"
+)
+
+// oidcStateTTL is how long a user has to sign in with the identity provider.
+const oidcStateTTL = 10 * time.Minute
+
+// errUnverifiedEmail is returned when an identity provider account can't be linked to
+// a user, because the provider hasn't verified its email address.
+var errUnverifiedEmail = errors.New("identity provider email address not verified")
+
+// The getOIDCProvider() helper returns the provider named in the URL, sending a 404
+// Not Found response and returning nil if there is no such provider.
+func (app *application) getOIDCProvider(w http.ResponseWriter, r *http.Request) *oidc.Provider {
+	name := httprouter.ParamsFromContext(r.Context()).ByName("provider")
+	provider, ok := app.oidcProviders[name]
+	if !ok {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+	return provider
+}
+
+// Start signing in with an identity provider. The response has the URL to send the
+// user to, and the state, which the client should keep so that it can check the state
+// the provider sends back. The nonce and PKCE verifier never leave the server.
+func (app *application) createOIDCAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	provider := app.getOIDCProvider(w, r)
+	if provider == nil {
+		return
+	}
+	nonce, err := oidc.RandomString()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	verifier, err := oidc.RandomString()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	state, err := app.models.Identities.NewState(provider.Name, nonce, verifier, oidcStateTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	authorizationURL, err := provider.AuthCodeURL(ctx, state.Plaintext, nonce, verifier)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	env := envelope{"authorization_url": authorizationURL, "state": state.Plaintext, "expiry": state.Expiry}
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Finish signing in with an identity provider. The client sends us the code and state
+// that the provider redirected the user back with, and we exchange the code for the
+// user's ID token. The user is found by their provider account, or by the provider's
+// verified email address (creating a new user if there isn't one), and then logged in
+// as usual.
+func (app *application) createOIDCAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	provider := app.getOIDCProvider(w, r)
+	if provider == nil {
+		return
+	}
+	var input struct {
+		Code  string `json:"code"`
+		State string `json:"state"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(input.Code != "", "code", "must be provided")
+	v.Check(input.State != "", "state", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// The state can only be used once, and only with the provider it was created for,
+	// which protects against forged callbacks.
+	state, err := app.models.Identities.TakeState(provider.Name, input.State)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("state", "invalid or expired state")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	claims, err := provider.Exchange(ctx, input.Code, state.CodeVerifier, state.Nonce)
+	if err != nil {
+		switch {
+		case errors.Is(err, oidc.ErrExchangeFailed), errors.Is(err, oidc.ErrInvalidIDToken):
+			app.logger.PrintInfo("identity provider login failed", map[string]string{
+				"provider": provider.Name,
+				"error":    err.Error(),
+			})
+			app.oidcLoginFailedResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	user, err := app.userForIdentity(provider.Name, claims)
+	if err != nil {
+		switch {
+		case errors.Is(err, errUnverifiedEmail):
+			app.unverifiedIdentityResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if user.Disabled {
+		app.disabledAccountResponse(w, r)
+		return
+	}
+	app.completeLogin(w, r, user)
+}
+
+// The userForIdentity() helper returns the user for an identity provider account,
+// linking the account to a user the first time it's used. We only link by email
+// address when the provider says that it has verified it. Signing in this way proves
+// that the user owns the address, so their account is activated as well, after taking
+// it back from whoever registered it (see resetUnactivatedUser()).
+func (app *application) userForIdentity(provider string, claims *oidc.Claims) (*data.User, error) {
+	userID, err := app.models.Identities.GetUserID(provider, claims.Subject)
+	switch {
+	case err == nil:
+		return app.models.Users.Get(userID)
+	case !errors.Is(err, data.ErrRecordNotFound):
+		return nil, err
+	}
+	if !claims.EmailVerified || !validator.Matches(claims.Email, validator.EmailRX) {
+		return nil, errUnverifiedEmail
+	}
+	user, err := app.models.Users.GetByEmail(claims.Email)
+	switch {
+	case err == nil:
+		if !user.Activated {
+			err = app.resetUnactivatedUser(user)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case errors.Is(err, data.ErrRecordNotFound):
+		user, err = app.createIdentityUser(claims)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	err = app.models.Identities.Link(user.ID, provider, claims.Subject, claims.Email)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// The resetUnactivatedUser() helper activates an account which was registered with
+// the email address but never activated, before it's linked to an identity provider
+// account. Whoever registered it never proved that they own the address, so it might
+// have been someone planning to get into the account once its real owner starts using
+// it. Their password (replaced with a random one, as for new identity users), tokens
+// and two-factor setup are all thrown away.
+func (app *application) resetUnactivatedUser(user *data.User) error {
+	scopes := []string{
+		data.ScopeActivation,
+		data.ScopeAuthentication,
+		data.ScopePasswordReset,
+		data.ScopeRefresh,
+		data.ScopeEmailChange,
+		data.ScopeMFAChallenge,
+	}
+	for _, scope := range scopes {
+		err := app.models.Tokens.DeleteAllForUser(scope, user.ID)
+		if err != nil {
+			return err
+		}
+	}
+	err := app.revokeAllJWTs(user.ID)
+	if err != nil {
+		return err
+	}
+	err = app.models.MFA.DisableTOTP(user.ID)
+	if err != nil {
+		return err
+	}
+	password, err := oidc.RandomString()
+	if err != nil {
+		return err
+	}
+	err = user.Password.Set(password)
+	if err != nil {
+		return err
+	}
+	user.Activated = true
+	return app.models.Users.Update(user)
+}
+
+// The createIdentityUser() helper registers a new, activated user for an identity
+// provider account. They get a random password, which they can replace through the
+// password reset flow if they ever want to log in with one.
+func (app *application) createIdentityUser(claims *oidc.Claims) (*data.User, error) {
+	name := strings.TrimSpace(claims.Name)
+	if name == "" {
+		name, _, _ = strings.Cut(claims.Email, "@")
+	}
+	name = data.Truncate(name, 500)
+	user := &data.User{
+		Name:      name,
+		Email:     claims.Email,
+		Activated: true,
+	}
+	password, err := oidc.RandomString()
+	if err != nil {
+		return nil, err
+	}
+	err = user.Password.Set(password)
+	if err != nil {
+		return nil, err
+	}
+	err = app.models.Users.Insert(user)
+	if err != nil {
+		return nil, err
+	}
+	if app.config.roles.defaultRole != "" {
+		err = app.models.Roles.AddForUser(user.ID, app.config.roles.defaultRole)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"personalized_gifts.sanzhar.net/internal/data"
+	"personalized_gifts.sanzhar.net/internal/validator"
+)
+
+func (app *application) createOrderHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RecipientName string    `json:"recipient_name"`
+		DeliveryDate  data.Date `json:"delivery_date"`
+		GiftMessage   string    `json:"gift_message"`
+		Items         []struct {
+			GiftID        int64  `json:"gift_id"`
+			Quantity      int32  `json:"quantity"`
+			EngravingText string `json:"engraving_text"`
+		} `json:"items"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	user := app.contextGetUser(r)
+	order := &data.Order{
+		UserID:        user.ID,
+		Status:        data.OrderPending,
+		RecipientName: input.RecipientName,
+		DeliveryDate:  input.DeliveryDate,
+		GiftMessage:   input.GiftMessage,
+	}
+	for _, item := range input.Items {
+		giftID := item.GiftID
+		order.Items = append(order.Items, &data.OrderItem{
+			GiftID:        &giftID,
+			Quantity:      item.Quantity,
+			EngravingText: item.EngravingText,
+		})
+	}
+	v := validator.New()
+	data.ValidateDeliveryDate(v, order.DeliveryDate)
+	data.ValidateOrderGifts(v, order)
+	if data.ValidateOrder(v, order); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Orders.Insert(order)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrGiftNotFound):
+			v.AddError("items", "must only contain existing gifts")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/orders/%d", order.ID))
+	err = app.writeJSON(w, http.StatusCreated, envelope{"order": order}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The getOrderForUser() helper fetches an order, returning ErrRecordNotFound if the
+// user is neither its owner nor has the orders:manage permission. We deliberately
+// don't distinguish the two cases, so that users can't probe for other people's
+// order IDs. It also reports whether the user is a manager.
+func (app *application) getOrderForUser(r *http.Request, id int64) (*data.Order, bool, error) {
+	user := app.contextGetUser(r)
+	manager, err := app.userHasPermission(r, "orders:manage")
+	if err != nil {
+		return nil, false, err
+	}
+	order, err := app.models.Orders.Get(id)
+	if err != nil {
+		return nil, false, err
+	}
+	if order.UserID != user.ID && !manager {
+		return nil, false, data.ErrRecordNotFound
+	}
+	return order, manager, nil
+}
+
+func (app *application) showOrderHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	order, _, err := app.getOrderForUser(r, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"order": order}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Statuses []string
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	input.Statuses = app.readCSV(qs, "status", []string{})
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-created_at")
+	input.Filters.SortSafelist = []string{"id", "created_at", "delivery_date", "status", "-id", "-created_at", "-delivery_date", "-status"}
+	for _, status := range input.Statuses {
+		v.Check(validator.In(status, data.OrderStatuses...), "status", "must only contain pending, confirmed, shipped, delivered or cancelled")
+	}
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// Users only ever see their own orders, unless they have the orders:manage
+	// permission, in which case they see everyone's.
+	user := app.contextGetUser(r)
+	manager, err := app.userHasPermission(r, "orders:manage")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	userID := user.ID
+	if manager {
+		userID = 0
+	}
+	orders, metadata, err := app.models.Orders.GetAll(userID, input.Statuses, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"orders": orders, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateOrderHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	order, manager, err := app.getOrderForUser(r, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	var input struct {
+		Status        *string    `json:"status"`
+		RecipientName *string    `json:"recipient_name"`
+		DeliveryDate  *data.Date `json:"delivery_date"`
+		GiftMessage   *string    `json:"gift_message"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	// Customers can change the personalization of their order, or cancel it, only
+	// while it is still pending. Staff with orders:manage can change anything.
+	if !manager {
+		v.Check(order.Status == data.OrderPending, "status", "order can no longer be changed")
+		if input.Status != nil {
+			v.Check(*input.Status == data.OrderCancelled, "status", "can only be changed to cancelled")
+		}
+	}
+	if input.Status != nil {
+		order.Status = *input.Status
+	}
+	if input.RecipientName != nil {
+		order.RecipientName = *input.RecipientName
+	}
+	if input.DeliveryDate != nil {
+		order.DeliveryDate = *input.DeliveryDate
+		data.ValidateDeliveryDate(v, order.DeliveryDate)
+	}
+	if input.GiftMessage != nil {
+		order.GiftMessage = *input.GiftMessage
+	}
+	if data.ValidateOrder(v, order); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Orders.Update(order)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"order": order}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
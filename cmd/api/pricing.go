@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"personalized_gifts.sanzhar.net/internal/data"
+	"personalized_gifts.sanzhar.net/internal/validator"
+)
+
+func (app *application) listMultipliersHandler(w http.ResponseWriter, r *http.Request) {
+	multipliers, err := app.models.Pricing.GetAllMultipliers()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"multipliers": multipliers}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) setMultiplierHandler(w http.ResponseWriter, r *http.Request) {
+	superiority := httprouter.ParamsFromContext(r.Context()).ByName("superiority")
+	if !validator.In(superiority, data.GiftSuperiorities...) {
+		app.notFoundResponse(w, r)
+		return
+	}
+	var input struct {
+		Multiplier float64 `json:"multiplier"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	multiplier := &data.SuperiorityMultiplier{
+		Superiority: superiority,
+		Multiplier:  input.Multiplier,
+	}
+	v := validator.New()
+	if data.ValidateSuperiorityMultiplier(v, multiplier); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Pricing.SetMultiplier(multiplier)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"multiplier": multiplier}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteMultiplierHandler(w http.ResponseWriter, r *http.Request) {
+	superiority := httprouter.ParamsFromContext(r.Context()).ByName("superiority")
+	err := app.models.Pricing.DeleteMultiplier(superiority)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "multiplier successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
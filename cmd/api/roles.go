@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"personalized_gifts.sanzhar.net/internal/data"
+	"personalized_gifts.sanzhar.net/internal/validator"
+)
+
+func (app *application) listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.models.Roles.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string   `json:"name"`
+		Description string   `json:"description"`
+		Permissions []string `json:"permissions"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	role := &data.Role{
+		Name:        input.Name,
+		Description: input.Description,
+		Permissions: input.Permissions,
+	}
+	if role.Permissions == nil {
+		role.Permissions = data.Permissions{}
+	}
+	v := validator.New()
+	err = app.validatePermissionCodes(v, "permissions", role.Permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if data.ValidateRole(v, role); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Roles.Insert(role)
+	if err != nil {
+		app.roleErrorResponse(w, r, v, err)
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/admin/roles/%d", role.ID))
+	err = app.writeJSON(w, http.StatusCreated, envelope{"role": role}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The getRoleParam() helper fetches the role named by the "id" URL parameter, sending
+// a 404 Not Found response and returning nil if there isn't one.
+func (app *application) getRoleParam(w http.ResponseWriter, r *http.Request) *data.Role {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+	role, err := app.models.Roles.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return role
+}
+
+func (app *application) showRoleHandler(w http.ResponseWriter, r *http.Request) {
+	role := app.getRoleParam(w, r)
+	if role == nil {
+		return
+	}
+	err := app.writeJSON(w, http.StatusOK, envelope{"role": role}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Update a role. If the permissions are given they replace the role's current ones.
+// When that takes permissions away, the JWTs of everyone with the role are revoked, so
+// that they have to refresh them to pick up the new permissions.
+func (app *application) updateRoleHandler(w http.ResponseWriter, r *http.Request) {
+	role := app.getRoleParam(w, r)
+	if role == nil {
+		return
+	}
+	var input struct {
+		Name        *string  `json:"name"`
+		Description *string  `json:"description"`
+		Permissions []string `json:"permissions"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if input.Name != nil {
+		v.Check(role.Name != app.config.roles.defaultRole || *input.Name == role.Name, "name", "the default role can't be renamed")
+		role.Name = *input.Name
+	}
+	if input.Description != nil {
+		role.Description = *input.Description
+	}
+	permissionsRemoved := false
+	if input.Permissions != nil {
+		for _, code := range role.Permissions {
+			if !validator.In(code, input.Permissions...) {
+				permissionsRemoved = true
+			}
+		}
+		role.Permissions = input.Permissions
+	}
+	err = app.validatePermissionCodes(v, "permissions", role.Permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if data.ValidateRole(v, role); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Roles.Update(role)
+	if err != nil {
+		app.roleErrorResponse(w, r, v, err)
+		return
+	}
+	if permissionsRemoved {
+		userIDs, err := app.models.Roles.GetUserIDs(role.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		err = app.revokeAllJWTs(userIDs...)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"role": role}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteRoleHandler(w http.ResponseWriter, r *http.Request) {
+	role := app.getRoleParam(w, r)
+	if role == nil {
+		return
+	}
+	// New users are given the default role, so it can't be deleted.
+	if role.Name == app.config.roles.defaultRole {
+		v := validator.New()
+		v.AddError("name", "the default role can't be deleted")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	// Find out who has the role before it's deleted, so that their JWTs, which still
+	// carry its permissions, can be revoked afterwards.
+	userIDs, err := app.models.Roles.GetUserIDs(role.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.Roles.Delete(role.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.revokeAllJWTs(userIDs...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "role successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) addUserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getUserParam(w, r)
+	if user == nil {
+		return
+	}
+	var input struct {
+		Roles []string `json:"roles"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	roles, err := app.models.Roles.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	known := make([]string, len(roles))
+	for i, role := range roles {
+		known[i] = role.Name
+	}
+	v := validator.New()
+	v.Check(len(input.Roles) > 0, "roles", "must contain at least 1 role")
+	for _, name := range input.Roles {
+		v.Check(validator.In(name, known...), "roles", "must only contain existing roles")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Roles.AddForUser(user.ID, input.Roles...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.writeUserWithPermissions(w, r, user)
+}
+
+func (app *application) removeUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getUserParam(w, r)
+	if user == nil {
+		return
+	}
+	name := httprouter.ParamsFromContext(r.Context()).ByName("role")
+	err := app.models.Roles.RemoveForUser(user.ID, name)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// As when revoking a permission, make the user refresh any JWTs they have.
+	err = app.revokeAllJWTs(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.writeUserWithPermissions(w, r, user)
+}
+
+func (app *application) roleErrorResponse(w http.ResponseWriter, r *http.Request, v *validator.Validator, err error) {
+	switch {
+	case errors.Is(err, data.ErrDuplicateRoleName):
+		v.AddError("name", "a role with this name already exists")
+		app.failedValidationResponse(w, r, v.Errors)
+	case errors.Is(err, data.ErrEditConflict):
+		app.editConflictResponse(w, r)
+	default:
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"expvar"
 	"github.com/julienschmidt/httprouter"
 	"net/http"
+	"strings"
 )
 
 // Update the routes() method to return a http.Handler instead of a *httprouter.Router.
@@ -12,15 +14,87 @@ func (app *application) routes() http.Handler {
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
 	// Use the requirePermission() middleware on each of the /v1/movies** endpoints,
-	// passing in the required permission code as the first parameter.
+	// passing in the required permission code as the first parameter. The endpoints
+	// which change a gift use requireGiftWriter() to check who owns it.
 	router.HandlerFunc(http.MethodGet, "/v1/gifts", app.requirePermission("gifts:read", app.listGiftsHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/gifts", app.requirePermission("gifts:write", app.createGiftHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/gifts", app.requireAnyPermission([]string{"gifts:write:own", "gifts:write:any"}, app.createGiftHandler))
 	router.HandlerFunc(http.MethodGet, "/v1/gifts/:id", app.requirePermission("gifts:read", app.showGiftHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/gifts/:id", app.requirePermission("gifts:write", app.updateGiftHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/gifts/:id", app.requirePermission("gifts:write", app.deleteGiftHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/gifts/:id", app.requireGiftWriter(app.updateGiftHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/gifts/:id", app.requireGiftWriter(app.deleteGiftHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/gifts/:id/transitions", app.requireGiftWriter(app.createGiftTransitionHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/gifts/:id/history", app.requirePermission("gifts:read", app.listGiftHistoryHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/gifts/:id/images", app.requirePermission("gifts:read", app.listGiftImagesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/gifts/:id/images", app.requireGiftWriter(app.uploadGiftImageHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/gifts/:id/images/:image_id", app.requireGiftWriter(app.updateGiftImageHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/gifts/:id/images/:image_id", app.requireGiftWriter(app.deleteGiftImageHandler))
+	// When the storage backend serves its own files (like the local filesystem one
+	// does), mount it under the configured base URL.
+	if h, ok := app.storage.(http.Handler); ok && strings.HasPrefix(app.config.storage.baseURL, "/") {
+		prefix := strings.TrimSuffix(app.config.storage.baseURL, "/")
+		router.Handler(http.MethodGet, prefix+"/*filepath", http.StripPrefix(prefix, h))
+	}
+	router.HandlerFunc(http.MethodGet, "/v1/tags", app.requirePermission("gifts:read", app.listTagsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/categories", app.listCategoriesHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/categories", app.requirePermission("categories:write", app.createCategoryHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/categories/:id", app.showCategoryHandler)
+	router.HandlerFunc(http.MethodPatch, "/v1/categories/:id", app.requirePermission("categories:write", app.updateCategoryHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/categories/:id", app.requirePermission("categories:write", app.deleteCategoryHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/pricing/multipliers", app.requirePermission("gifts:read", app.listMultipliersHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/pricing/multipliers/:superiority", app.requirePermission("pricing:write", app.setMultiplierHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/pricing/multipliers/:superiority", app.requirePermission("pricing:write", app.deleteMultiplierHandler))
+	// Routes which any activated user can use, rather than needing a permission, can't
+	// be used with API keys, as keys are limited to the permissions they were given.
+	router.HandlerFunc(http.MethodGet, "/v1/orders", app.requireUserSession(app.requireActivatedUser(app.listOrdersHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/orders", app.requireUserSession(app.requireActivatedUser(app.createOrderHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/orders/:id", app.requireUserSession(app.requireActivatedUser(app.showOrderHandler)))
+	router.HandlerFunc(http.MethodPatch, "/v1/orders/:id", app.requireUserSession(app.requireActivatedUser(app.updateOrderHandler)))
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/email", app.confirmEmailChangeHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/me", app.requireUserSession(app.showCurrentUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireUserSession(app.updateCurrentUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me", app.requireUserSession(app.deleteCurrentUserHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/password", app.requireUserSession(app.updateCurrentUserPasswordHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/email", app.requireUserSession(app.createEmailChangeHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/mfa", app.requireUserSession(app.showMFAHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/mfa/totp", app.requireUserSession(app.startTOTPEnrollmentHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/mfa/totp", app.requireUserSession(app.confirmTOTPEnrollmentHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/mfa/totp", app.requireUserSession(app.disableTOTPHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/mfa/recovery-codes", app.requireUserSession(app.regenerateRecoveryCodesHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/gifts", app.requireUserSession(app.requireActivatedUser(app.listMyGiftsHandler)))
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/mfa", app.createMFAAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/mfa/enrollment", app.startChallengeEnrollmentHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/tokens/mfa/enrollment", app.confirmChallengeEnrollmentHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/oidc/:provider/authorization", app.createOIDCAuthorizationHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/oidc/:provider", app.createOIDCAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireUserSession(app.deleteAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/tokens", app.requireUserSession(app.listTokensHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens", app.requireUserSession(app.deleteAllTokensHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/api-keys", app.requireUserSession(app.requireActivatedUser(app.listAPIKeysHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/api-keys", app.requireUserSession(app.requireActivatedUser(app.createAPIKeyHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/api-keys/:id", app.requireUserSession(app.requireActivatedUser(app.deleteAPIKeyHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users", app.requirePermission("users:admin", app.listUsersHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id", app.requirePermission("users:admin", app.showUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/admin/users/:id", app.requirePermission("users:admin", app.updateUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/lock", app.requirePermission("users:admin", app.unlockUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/permissions", app.requirePermission("users:admin", app.grantUserPermissionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/permissions/:code", app.requirePermission("users:admin", app.revokeUserPermissionHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/roles", app.requirePermission("users:admin", app.addUserRolesHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/roles/:role", app.requirePermission("users:admin", app.removeUserRoleHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/roles", app.requirePermission("users:admin", app.listRolesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/roles", app.requirePermission("users:admin", app.createRoleHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/roles/:id", app.requirePermission("users:admin", app.showRoleHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/admin/roles/:id", app.requirePermission("users:admin", app.updateRoleHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/roles/:id", app.requirePermission("users:admin", app.deleteRoleHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/permissions", app.requirePermission("users:admin", app.listPermissionsHandler))
+	// The expvar handler exposes runtime metrics like the permission cache counters,
+	// as well as the command line, so it needs its own permission.
+	router.HandlerFunc(http.MethodGet, "/debug/vars", app.requirePermission("metrics:read", expvar.Handler().ServeHTTP))
 	// Add the enableCORS() middleware.
 	return app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router))))
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/hex"
 	"errors"
 	"net/http"
 	"personalized_gifts.sanzhar.net/internal/data"
@@ -27,14 +28,21 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
+	// Refuse the attempt if there have been too many recent failures for this email
+	// address or from this IP address.
+	status := app.checkLoginAllowed(w, r, input.Email)
+	if status == nil {
+		return
+	}
 	// Lookup the user record based on the email address. If no matching user was
-	// found, then we call the app.invalidCredentialsResponse() helper to send a 401
-	// Unauthorized response to the client (we will create this helper in a moment).
+	// found, we still spend the time checking a password, so that the response can't
+	// be told apart from one for a wrong password, and record the failure as usual.
 	user, err := app.models.Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
-			app.invalidCredentialsResponse(w, r)
+			data.CompareDummyPassword(input.Password)
+			app.recordLoginFailure(w, r, input.Email, status, nil)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -46,22 +54,345 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	// If the passwords don't match, then we call the app.invalidCredentialsResponse()
-	// helper again and return.
+	// If the passwords don't match, then we record the failure, which sends the
+	// response, and return.
 	if !match {
-		app.invalidCredentialsResponse(w, r)
+		app.recordLoginFailure(w, r, input.Email, status, user)
 		return
 	}
-	// Otherwise, if the password is correct, we generate a new token with a 24-hour
-	// expiry time and the scope 'authentication'.
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	// The password was right, so forget about this attempt and any earlier failures
+	// for this email.
+	err = app.models.Logins.Clear(input.Email)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	// Encode the token to JSON and send it in the response along with a 201 Created
+	// Accounts which an administrator has disabled can't log in.
+	if user.Disabled {
+		app.disabledAccountResponse(w, r)
+		return
+	}
+	app.completeLogin(w, r, user)
+}
+
+// The completeLogin() helper finishes a login once the user has proved who they are,
+// with a password or through an identity provider. Accounts with two-factor
+// authentication need a second step before they get their tokens. So do accounts
+// which must use it but haven't set it up yet, which need to enroll first.
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, user *data.User) {
+	totp, err := app.models.MFA.GetTOTP(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	required, err := app.mfaRequired(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if totp.Enabled || required {
+		app.createMFAChallenge(w, r, user, !totp.Enabled)
+		return
+	}
+	// Otherwise we send the client its tokens.
+	app.writeAuthenticationTokens(w, r, user, false, envelope{})
+}
+
+// The writeAuthenticationTokens() helper logs the user in. We generate a short-lived
+// access token with the scope 'authentication', and a refresh token which the client
+// can use to get a new one when it expires, and send them to the client along with
+// anything else in env. mfa is whether the user used two-factor authentication.
+func (app *application) writeAuthenticationTokens(w http.ResponseWriter, r *http.Request, user *data.User, mfa bool, env envelope) {
+	access, refreshToken, err := app.models.Tokens.NewPair(user.ID, mfa, app.config.tokens.accessTTL, app.config.tokens.refreshTTL, r.UserAgent(), app.clientIP(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	token, err := app.issueAccessToken(user, access)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	env["authentication_token"] = token
+	env["refresh_token"] = refreshToken
+	// Encode the tokens to JSON and send them in the response along with a 201 Created
 	// status code.
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Exchange a refresh token for a new access token and refresh token. Refresh tokens
+// are rotated, so the one in the request can't be used again.
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	access, refreshToken, err := app.models.Tokens.Rotate(input.RefreshToken, app.config.tokens.accessTTL, app.config.tokens.refreshTTL, r.UserAgent(), app.clientIP(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		case errors.Is(err, data.ErrTokenReused):
+			// The whole session has been revoked, so log the event for investigation.
+			app.logger.PrintInfo("refresh token reused, session revoked", map[string]string{"ip": app.clientIP(r)})
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Fetch the user again, so that a JWT access token has up to date details and
+	// permissions.
+	user, err := app.models.Users.Get(access.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if user.Disabled {
+		app.disabledAccountResponse(w, r)
+		return
+	}
+	// A session which didn't use two-factor authentication can't be refreshed once the
+	// user is required to use it, for example because they have been given a
+	// permission which needs it since they logged in. They have to log in again.
+	if !access.MFA {
+		required, err := app.mfaRequired(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if required {
+			err = app.models.Tokens.DeleteFamily(user.ID, access.Family)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			app.mfaRequiredResponse(w, r)
+			return
+		}
+	}
+	token, err := app.issueAccessToken(user, access)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token, "refresh_token": refreshToken}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Generate a password reset token and send it to the user's email address. We always
+// send the same 202 Accepted response, whether or not the email address belongs to an
+// activated account, so that this endpoint can't be used to find out who is
+// registered.
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	env := envelope{"message": "if an activated account exists for this email address, you will receive an email containing password reset instructions"}
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if user.Activated {
+		token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.background(func() {
+			data := map[string]interface{}{
+				"passwordResetToken": token.Plaintext,
+			}
+			err = app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Activation emails can only be resent to the same address once in this interval.
+const activationResendInterval = 5 * time.Minute
+
+// Generate a new activation token for an unactivated user and email it to them. As
+// with password reset tokens, we send the same response whatever the state of the
+// account, so this can't be used to find out who is registered.
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	env := envelope{"message": "if an unactivated account exists for this email address, you will receive an email containing activation instructions"}
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if user != nil && !user.Activated {
+		// Rate limit per email address. The previous token's expiry tells us when it
+		// was sent, and this works across every instance of the API because it's
+		// stored in the database.
+		ttl := 3 * 24 * time.Hour
+		expiry, err := app.models.Tokens.LatestExpiryForUser(data.ScopeActivation, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if time.Until(expiry) < ttl-activationResendInterval {
+			err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			token, err := app.models.Tokens.New(user.ID, ttl, data.ScopeActivation)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			app.background(func() {
+				data := map[string]interface{}{
+					"activationToken": token.Plaintext,
+				}
+				err = app.mailer.Send(user.Email, "token_activation.tmpl", data)
+				if err != nil {
+					app.logger.PrintError(err, nil)
+				}
+			})
+		}
+	}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Revoke the authentication token that the request was made with, and the refresh
+// token for the same session, logging the client out.
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	// A JWT can't be deleted, so we add it to the denylist instead, and delete the
+	// rest of its session from the database.
+	if claims := app.contextGetClaims(r); claims != nil {
+		err := app.revokeJWT(user.ID, claims)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		family, err := hex.DecodeString(claims.SessionID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		err = app.models.Tokens.DeleteFamily(user.ID, family)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out"}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err := app.models.Tokens.Delete(data.ScopeAuthentication, user.ID, app.contextGetToken(r))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// List the user's active sessions.
+func (app *application) listTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID, app.contextGetToken(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// For a JWT, the current session is the one named in its claims.
+	if claims := app.contextGetClaims(r); claims != nil {
+		for _, session := range sessions {
+			session.Current = hex.EncodeToString(session.Family) == claims.SessionID
+		}
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Revoke all of the user's authentication tokens, logging them out everywhere. This
+// includes the token the request was made with.
+func (app *application) deleteAllTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh} {
+		err := app.models.Tokens.DeleteAllForUser(scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	err := app.revokeAllJWTs(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out of all sessions"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
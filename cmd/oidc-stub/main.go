@@ -0,0 +1,252 @@
+// The oidc-stub command is a minimal OpenID Connect identity provider for trying out
+// and testing social login locally. Every sign in succeeds straight away, as the user
+// given by the -email and -name flags (or by a login_hint parameter), without asking
+// for anything. It must never be exposed publicly.
+//
+// To use it, run it and start the API with a matching provider:
+//
+//	go run ./cmd/oidc-stub -addr :9000
+//	go run ./cmd/api -oidc-provider name=stub,issuer=http://localhost:9000,client-id=gifts,client-secret=secret,redirect-url=http://localhost:3000/callback
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var encoding = base64.RawURLEncoding
+
+type config struct {
+	addr         string
+	issuer       string
+	clientID     string
+	clientSecret string
+	email        string
+	name         string
+	verified     bool
+}
+
+// A grant is an authorization code which hasn't been exchanged yet.
+type grant struct {
+	redirectURI   string
+	nonce         string
+	codeChallenge string
+	email         string
+	expiry        time.Time
+}
+
+type provider struct {
+	config config
+	key    *rsa.PrivateKey
+	mu     sync.Mutex
+	grants map[string]grant
+}
+
+func main() {
+	var cfg config
+	flag.StringVar(&cfg.addr, "addr", ":9000", "Address to listen on")
+	flag.StringVar(&cfg.issuer, "issuer", "http://localhost:9000", "Issuer URL, which must match how the API reaches this server")
+	flag.StringVar(&cfg.clientID, "client-id", "gifts", "Client ID to accept")
+	flag.StringVar(&cfg.clientSecret, "client-secret", "secret", "Client secret to accept (empty for a public client)")
+	flag.StringVar(&cfg.email, "email", "stub.user@example.com", "Email address of the signed in user")
+	flag.StringVar(&cfg.name, "name", "Stub User", "Name of the signed in user")
+	flag.BoolVar(&cfg.verified, "email-verified", true, "Whether to say that the email address is verified")
+	flag.Parse()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p := &provider{config: cfg, key: key, grants: make(map[string]grant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discoveryHandler)
+	mux.HandleFunc("/jwks", p.jwksHandler)
+	mux.HandleFunc("/authorize", p.authorizeHandler)
+	mux.HandleFunc("/token", p.tokenHandler)
+	log.Printf("stub identity provider listening on %s as %s", cfg.addr, cfg.issuer)
+	log.Fatal(http.ListenAndServe(cfg.addr, mux))
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+// writeError sends an OAuth 2.0 error response.
+func writeError(w http.ResponseWriter, code, description string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code, "error_description": description})
+}
+
+func (p *provider) discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.config.issuer,
+		"authorization_endpoint":                p.config.issuer + "/authorize",
+		"token_endpoint":                        p.config.issuer + "/token",
+		"jwks_uri":                              p.config.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (p *provider) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "stub",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   encoding.EncodeToString(p.key.N.Bytes()),
+			"e":   encoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+// authorizeHandler signs the user in straight away, and redirects them back to the
+// client with an authorization code.
+func (p *provider) authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	switch {
+	case q.Get("response_type") != "code":
+		writeError(w, "unsupported_response_type", "response_type must be code")
+		return
+	case q.Get("client_id") != p.config.clientID:
+		writeError(w, "unauthorized_client", "unknown client_id")
+		return
+	case q.Get("redirect_uri") == "":
+		writeError(w, "invalid_request", "redirect_uri is required")
+		return
+	case q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256":
+		writeError(w, "invalid_request", "an S256 code_challenge is required")
+		return
+	}
+	email := q.Get("login_hint")
+	if email == "" {
+		email = p.config.email
+	}
+	code := randomString()
+	p.mu.Lock()
+	p.grants[code] = grant{
+		redirectURI:   q.Get("redirect_uri"),
+		nonce:         q.Get("nonce"),
+		codeChallenge: q.Get("code_challenge"),
+		email:         email,
+		expiry:        time.Now().Add(time.Minute),
+	}
+	p.mu.Unlock()
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil {
+		writeError(w, "invalid_request", "invalid redirect_uri")
+		return
+	}
+	params := redirect.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// tokenHandler exchanges an authorization code for a signed ID token, checking the
+// client credentials and the PKCE verifier.
+func (p *provider) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, "invalid_request", err.Error())
+		return
+	}
+	clientID, clientSecret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != p.config.clientID || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(p.config.clientSecret)) != 1 {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	code := r.PostForm.Get("code")
+	p.mu.Lock()
+	g, ok := p.grants[code]
+	delete(p.grants, code)
+	p.mu.Unlock()
+	switch {
+	case r.PostForm.Get("grant_type") != "authorization_code":
+		writeError(w, "unsupported_grant_type", "grant_type must be authorization_code")
+		return
+	case !ok || time.Now().After(g.expiry):
+		writeError(w, "invalid_grant", "unknown or expired code")
+		return
+	case r.PostForm.Get("redirect_uri") != g.redirectURI:
+		writeError(w, "invalid_grant", "redirect_uri doesn't match")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if encoding.EncodeToString(sum[:]) != g.codeChallenge {
+		writeError(w, "invalid_grant", "code_verifier doesn't match")
+		return
+	}
+	now := time.Now()
+	idToken, err := p.sign(map[string]interface{}{
+		"iss":            p.config.issuer,
+		"sub":            "stub|" + g.email,
+		"aud":            p.config.clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"nonce":          g.nonce,
+		"email":          g.email,
+		"email_verified": p.config.verified,
+		"name":           p.config.name,
+	})
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+// sign returns the claims as an RS256 JWT.
+func (p *provider) sign(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "stub"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := encoding.EncodeToString(header) + "." + encoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return input + "." + encoding.EncodeToString(signature), nil
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return encoding.EncodeToString(b)
+}
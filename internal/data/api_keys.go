@@ -0,0 +1,249 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"github.com/lib/pq"
+	"net/netip"
+	"personalized_gifts.sanzhar.net/internal/validator"
+	"strings"
+	"time"
+)
+
+// APIKeyPrefix starts every API key, so that keys are easy to tell apart from tokens
+// (and easy for secret scanners to spot if one is leaked).
+const APIKeyPrefix = "pgk_"
+
+// An APIKey lets a program call the API on behalf of the user who owns it, with some
+// of that user's permissions. Plaintext is only set when the key is created, which is
+// the only time it's shown; after that the key is identified by its Prefix.
+type APIKey struct {
+	ID          int64      `json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UserID      int64      `json:"-"`
+	Name        string     `json:"name"`
+	Prefix      string     `json:"prefix"`
+	Plaintext   string     `json:"key,omitempty"`
+	Hash        []byte     `json:"-"`
+	Permissions []string   `json:"permissions"`
+	AllowedIPs  []string   `json:"allowed_ips"`
+	Expiry      *time.Time `json:"expiry"`
+	LastUsed    *time.Time `json:"last_used"`
+	LastUsedIP  string     `json:"last_used_ip"`
+}
+
+// IsAPIKey reports whether s looks like an API key rather than a token.
+func IsAPIKey(s string) bool {
+	return strings.HasPrefix(s, APIKeyPrefix)
+}
+
+// AllowsIP reports whether the key can be used from the given IP address. Keys with an
+// empty allowlist can be used from anywhere.
+func (k *APIKey) AllowsIP(ip string) bool {
+	if len(k.AllowedIPs) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range k.AllowedIPs {
+		if prefix, err := parseAllowedIP(allowed); err == nil && prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// GrantedPermissions returns the key's permissions which its owner still has. Keys
+// never grant more than their owner's current permissions, so taking a permission
+// away from a user takes it away from their keys as well.
+func (k *APIKey) GrantedPermissions(userPermissions Permissions) Permissions {
+	granted := Permissions{}
+	for _, code := range k.Permissions {
+		if userPermissions.Include(code) {
+			granted = append(granted, code)
+		}
+	}
+	return granted
+}
+
+// parseAllowedIP() parses an allowlist entry, which is either a CIDR range or a single
+// IP address.
+func parseAllowedIP(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func ValidateAPIKey(v *validator.Validator, key *APIKey) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(key.Permissions) > 0, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+
+	v.Check(len(key.AllowedIPs) <= 20, "allowed_ips", "must not contain more than 20 entries")
+	for _, allowed := range key.AllowedIPs {
+		_, err := parseAllowedIP(allowed)
+		v.Check(err == nil, "allowed_ips", "must only contain IP addresses and CIDR ranges")
+	}
+
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+// Define the APIKeyModel type.
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+// Insert() generates the key's plaintext and saves the key. Like tokens, we only store
+// the SHA-256 hash of the plaintext.
+func (m APIKeyModel) Insert(key *APIKey) error {
+	randomBytes := make([]byte, 20)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+	key.Plaintext = APIKeyPrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	key.Prefix = key.Plaintext[:len(APIKeyPrefix)+8]
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+	if key.AllowedIPs == nil {
+		key.AllowedIPs = []string{}
+	}
+	query := `
+INSERT INTO api_keys (user_id, name, prefix, hash, permissions, allowed_ips, expiry)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+RETURNING id, created_at`
+	args := []interface{}{key.UserID, key.Name, key.Prefix, key.Hash, pq.Array(key.Permissions), pq.Array(key.AllowedIPs), key.Expiry}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+// GetByPlaintext() returns the key with the given plaintext, unless it has expired.
+func (m APIKeyModel) GetByPlaintext(plaintext string) (*APIKey, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+	query := `
+SELECT id, created_at, user_id, name, prefix, hash, permissions, allowed_ips, expiry, last_used, last_used_ip
+FROM api_keys
+WHERE hash = $1 AND (expiry IS NULL OR expiry > $2)`
+	var key APIKey
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, hash[:], time.Now()).Scan(
+		&key.ID,
+		&key.CreatedAt,
+		&key.UserID,
+		&key.Name,
+		&key.Prefix,
+		&key.Hash,
+		pq.Array(&key.Permissions),
+		pq.Array(&key.AllowedIPs),
+		&key.Expiry,
+		&key.LastUsed,
+		&key.LastUsedIP,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &key, nil
+}
+
+// GetAllForUser() returns all of the user's keys, including expired ones, newest first.
+func (m APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `
+SELECT id, created_at, user_id, name, prefix, hash, permissions, allowed_ips, expiry, last_used, last_used_ip
+FROM api_keys
+WHERE user_id = $1
+ORDER BY created_at DESC, id DESC`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []*APIKey{}
+	for rows.Next() {
+		var key APIKey
+		err := rows.Scan(
+			&key.ID,
+			&key.CreatedAt,
+			&key.UserID,
+			&key.Name,
+			&key.Prefix,
+			&key.Hash,
+			pq.Array(&key.Permissions),
+			pq.Array(&key.AllowedIPs),
+			&key.Expiry,
+			&key.LastUsed,
+			&key.LastUsedIP,
+		)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Touch() records that the key has been used, and where from. As with tokens, to avoid
+// a write on every request we only update it when last_used is more than a minute old,
+// or the key is being used from a different IP address.
+func (m APIKeyModel) Touch(id int64, ip string) error {
+	query := `
+UPDATE api_keys
+SET last_used = NOW(), last_used_ip = $2
+WHERE id = $1 AND (last_used IS NULL OR last_used < NOW() - INTERVAL '1 minute' OR last_used_ip <> $2)`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, id, ip)
+	return err
+}
+
+// Delete() deletes one of the user's keys.
+func (m APIKeyModel) Delete(id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	query := `
+DELETE FROM api_keys
+WHERE id = $1 AND user_id = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"personalized_gifts.sanzhar.net/internal/validator"
+	"strings"
+	"time"
+)
+
+var (
+	ErrDuplicateSlug = errors.New("duplicate slug")
+	// ErrCategoryCycle is returned when a category would become its own ancestor.
+	ErrCategoryCycle = errors.New("category cycle")
+	// ErrParentNotFound is returned when the parent of a category doesn't exist.
+	ErrParentNotFound = errors.New("parent category not found")
+	// ErrCategoryInUse is returned when deleting a category which still has gifts or
+	// subcategories.
+	ErrCategoryInUse = errors.New("category in use")
+)
+
+// giftCategorySlug is the SQL expression for the slug of a gift's category. We use a
+// scalar subquery rather than a JOIN so that the existing gift queries (and their
+// unqualified column names) keep working unchanged.
+const giftCategorySlug = `(SELECT categories.slug FROM categories WHERE categories.id = gifts.category_id)`
+
+// giftCategoryTree is the SQL condition matching gifts in any of the categories with
+// the slugs in $4, or in any of their descendants. An empty $4 matches every gift.
+const giftCategoryTree = `(cardinality($4::text[]) = 0 OR gifts.category_id IN (
+	WITH RECURSIVE tree AS (
+		SELECT categories.id FROM categories WHERE categories.slug = ANY($4)
+		UNION
+		SELECT categories.id FROM categories INNER JOIN tree ON categories.parent_id = tree.id
+	)
+	SELECT id FROM tree))`
+
+// A Category groups gifts for browsing. Categories form a tree: ParentID is nil for
+// top-level categories.
+type Category struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"-"`
+	Slug      string    `json:"slug"`
+	Name      string    `json:"name"`
+	ParentID  *int64    `json:"parent_id"`
+	Version   int32     `json:"version"`
+}
+
+func ValidateCategory(v *validator.Validator, category *Category) {
+	v.Check(category.Slug != "", "slug", "must be provided")
+	v.Check(len(category.Slug) <= 100, "slug", "must not be more than 100 bytes long")
+	v.Check(validator.Matches(category.Slug, validator.SlugRX), "slug", "must only contain lowercase letters, digits and single hyphens")
+
+	v.Check(category.Name != "", "name", "must be provided")
+	v.Check(len(category.Name) <= 200, "name", "must not be more than 200 bytes long")
+
+	if category.ParentID != nil {
+		v.Check(*category.ParentID > 0, "parent_id", "must be a positive integer")
+		v.Check(*category.ParentID != category.ID, "parent_id", "must not be the category itself")
+	}
+}
+
+// Define the CategoryModel type.
+type CategoryModel struct {
+	DB *sql.DB
+}
+
+func (m CategoryModel) Insert(category *Category) error {
+	query := `
+INSERT INTO categories (slug, name, parent_id)
+VALUES ($1, $2, $3)
+RETURNING id, created_at, version`
+	args := []interface{}{category.Slug, category.Name, category.ParentID}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&category.ID, &category.CreatedAt, &category.Version)
+	if err != nil {
+		return categoryError(err)
+	}
+	return nil
+}
+
+func (m CategoryModel) Get(id int64) (*Category, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	return m.get("id = $1", id)
+}
+
+func (m CategoryModel) GetBySlug(slug string) (*Category, error) {
+	return m.get("slug = $1", slug)
+}
+
+func (m CategoryModel) get(where string, arg interface{}) (*Category, error) {
+	query := `
+SELECT id, created_at, slug, name, parent_id, version
+FROM categories
+WHERE ` + where
+	var category Category
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, arg).Scan(
+		&category.ID,
+		&category.CreatedAt,
+		&category.Slug,
+		&category.Name,
+		&category.ParentID,
+		&category.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &category, nil
+}
+
+// GetAll() returns every category, ordered by name. There are few enough categories
+// that we don't paginate them, which lets clients build the whole navigation tree
+// from a single response.
+func (m CategoryModel) GetAll() ([]*Category, error) {
+	query := `
+SELECT id, created_at, slug, name, parent_id, version
+FROM categories
+ORDER BY name, id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	categories := []*Category{}
+	for rows.Next() {
+		var category Category
+		err := rows.Scan(
+			&category.ID,
+			&category.CreatedAt,
+			&category.Slug,
+			&category.Name,
+			&category.ParentID,
+			&category.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		categories = append(categories, &category)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return categories, nil
+}
+
+// Update() saves the category. If the parent is changing, we first make sure that the
+// new parent isn't the category itself or one of its descendants, which would turn
+// the tree into a loop. The check and the update happen in one transaction, with the
+// table locked against other writes, so two concurrent moves can't form a loop
+// between them either.
+func (m CategoryModel) Update(category *Category) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if category.ParentID != nil {
+		_, err = tx.ExecContext(ctx, `LOCK TABLE categories IN SHARE ROW EXCLUSIVE MODE`)
+		if err != nil {
+			return err
+		}
+		query := `
+WITH RECURSIVE descendants AS (
+	SELECT id FROM categories WHERE id = $1
+	UNION
+	SELECT categories.id FROM categories INNER JOIN descendants ON categories.parent_id = descendants.id
+)
+SELECT EXISTS (SELECT 1 FROM descendants WHERE id = $2)`
+		var cycle bool
+		err = tx.QueryRowContext(ctx, query, category.ID, *category.ParentID).Scan(&cycle)
+		if err != nil {
+			return err
+		}
+		if cycle {
+			return ErrCategoryCycle
+		}
+	}
+	query := `
+UPDATE categories
+SET slug = $1, name = $2, parent_id = $3, version = version + 1
+WHERE id = $4 AND version = $5
+RETURNING version`
+	args := []interface{}{category.Slug, category.Name, category.ParentID, category.ID, category.Version}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&category.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return categoryError(err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (m CategoryModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	query := `
+DELETE FROM categories
+WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return categoryError(err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// The categoryError() helper converts the constraint violations that clients can
+// trigger into our own error values.
+func categoryError(err error) error {
+	switch {
+	case err.Error() == `pq: duplicate key value violates unique constraint "categories_slug_key"`:
+		return ErrDuplicateSlug
+	case strings.Contains(err.Error(), `violates foreign key constraint "categories_parent_id_fkey"`):
+		// Either the new parent doesn't exist, or (on delete) the category still has
+		// subcategories.
+		if strings.HasPrefix(err.Error(), "pq: update or delete") {
+			return ErrCategoryInUse
+		}
+		return ErrParentNotFound
+	case strings.Contains(err.Error(), `violates foreign key constraint "gifts_category_id_fkey"`):
+		return ErrCategoryInUse
+	default:
+		return err
+	}
+}
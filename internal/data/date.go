@@ -0,0 +1,54 @@
+package data
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Define an error that our UnmarshalJSON() method can return if we're unable to parse
+// a date string.
+var ErrInvalidDateFormat = errors.New("invalid date format")
+
+// dateLayout is the format that dates are sent and received in ("2006-01-02").
+const dateLayout = time.DateOnly
+
+// Date is a calendar date without a time of day, like a delivery date. It is encoded
+// in JSON as a "YYYY-MM-DD" string and stored in PostgreSQL date columns.
+type Date struct {
+	time.Time
+}
+
+func (d Date) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(d.Format(dateLayout))), nil
+}
+
+func (d *Date) UnmarshalJSON(jsonValue []byte) error {
+	unquotedJSONValue, err := strconv.Unquote(string(jsonValue))
+	if err != nil {
+		return ErrInvalidDateFormat
+	}
+	t, err := time.Parse(dateLayout, unquotedJSONValue)
+	if err != nil {
+		return ErrInvalidDateFormat
+	}
+	d.Time = t
+	return nil
+}
+
+// Implement the sql.Scanner and driver.Valuer interfaces so that a Date can be read
+// from and written to the database directly.
+func (d *Date) Scan(src interface{}) error {
+	t, ok := src.(time.Time)
+	if !ok {
+		return fmt.Errorf("cannot scan %T into Date", src)
+	}
+	d.Time = t
+	return nil
+}
+
+func (d Date) Value() (driver.Value, error) {
+	return d.Format(dateLayout), nil
+}
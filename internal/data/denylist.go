@@ -0,0 +1,90 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// A Revocation denies JWTs before they expire. If JTI is set it denies that one
+// token; otherwise it denies every token for the user which was issued before
+// CreatedAt. Revocations are only needed until the tokens they cover have expired.
+type Revocation struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	JTI       string    `json:"jti,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Expiry    time.Time `json:"expiry"`
+}
+
+// Define the DenylistModel type.
+type DenylistModel struct {
+	DB *sql.DB
+}
+
+func (m DenylistModel) Insert(revocation *Revocation) error {
+	query := `
+INSERT INTO jwt_denylist (user_id, jti, created_at, expiry)
+VALUES ($1, $2, $3, $4)
+RETURNING id`
+	args := []interface{}{revocation.UserID, revocation.JTI, revocation.CreatedAt, revocation.Expiry}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&revocation.ID)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(revocation)
+	if err != nil {
+		return err
+	}
+	return notify(ctx, m.DB, DenylistChannel, string(payload))
+}
+
+// GetAllActive() returns the revocations which haven't expired yet. The API servers
+// hold these in memory, so that checking a token never needs a query.
+func (m DenylistModel) GetAllActive() ([]*Revocation, error) {
+	query := `
+SELECT id, user_id, jti, created_at, expiry
+FROM jwt_denylist
+WHERE expiry > $1
+ORDER BY id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	revocations := []*Revocation{}
+	for rows.Next() {
+		var revocation Revocation
+		err := rows.Scan(
+			&revocation.ID,
+			&revocation.UserID,
+			&revocation.JTI,
+			&revocation.CreatedAt,
+			&revocation.Expiry,
+		)
+		if err != nil {
+			return nil, err
+		}
+		revocations = append(revocations, &revocation)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return revocations, nil
+}
+
+// DeleteExpired() removes revocations for tokens which have all expired anyway.
+func (m DenylistModel) DeleteExpired() error {
+	query := `
+DELETE FROM jwt_denylist
+WHERE expiry <= $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, time.Now())
+	return err
+}
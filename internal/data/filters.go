@@ -1,17 +1,59 @@
 package data
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"math"
 	"personalized_gifts.sanzhar.net/internal/validator" // New import
+	"strconv"
 	"strings"
 )
 
-// Add a SortSafelist field to hold the supported sort values.
+// Add a SortSafelist field to hold the supported sort values. When CursorMode is true
+// the Page field is ignored and results are fetched relative to the opaque Cursor
+// instead (an empty Cursor means the first page). IntegerSorts maps the sort columns
+// holding integers to their size in bits, so that ValidateFilters() can reject cursors
+// whose value PostgreSQL couldn't cast back to the column type.
 type Filters struct {
 	Page         int
 	PageSize     int
 	Sort         string
 	SortSafelist []string
+	CursorMode   bool
+	Cursor       string
+	IntegerSorts map[string]int
+}
+
+// A cursor marks a position in a sorted result set by the value of the sort column
+// and the id of the row at that position. Backward is true for cursors which fetch
+// the page *before* the position rather than after it. The sort value is kept as
+// text, which lets PostgreSQL cast it back to the column type in the comparison.
+type cursor struct {
+	Sort     string `json:"s"`
+	Value    string `json:"v"`
+	ID       int64  `json:"i"`
+	Backward bool   `json:"b,omitempty"`
+}
+
+// Encode the cursor as URL-safe base64 JSON. Clients should treat the result as
+// opaque.
+func (c cursor) encode() string {
+	js, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	js, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(js, &c)
+	return c, err
 }
 
 // Check that the client-provided Sort field matches one of the entries in our safelist
@@ -41,6 +83,96 @@ func (f Filters) offset() int {
 	return (f.Page - 1) * f.PageSize
 }
 
+// The keyset() method returns the extra WHERE condition, ORDER BY clause and
+// arguments needed to fetch a page in cursor mode. The column parameter is the SQL
+// for the sort column (usually just sortColumn(), but it may be an expression), and n
+// is the number of the first free placeholder in the query. Unlike offset mode, rows
+// are tie-broken on id in the same direction as the sort, so the position can be
+// compared as a single row value which PostgreSQL can match against an index on
+// (column, id). For backward cursors the comparison and the ordering are reversed,
+// and the caller must reverse the rows.
+func (f Filters) keyset(column string, n int) (string, string, []interface{}) {
+	direction := f.sortDirection()
+	if f.Cursor == "" {
+		return "TRUE", fmt.Sprintf("%[1]s %[2]s, id %[2]s", column, direction), nil
+	}
+	// The cursor has already been checked by ValidateFilters().
+	c, _ := decodeCursor(f.Cursor)
+	if c.Backward {
+		direction = reverseDirection(direction)
+	}
+	op := ">"
+	if direction == "DESC" {
+		op = "<"
+	}
+	condition := fmt.Sprintf("(%[1]s, id) %[2]s ($%[3]d, $%[4]d)", column, op, n, n+1)
+	order := fmt.Sprintf("%[1]s %[2]s, id %[2]s", column, direction)
+	return condition, order, []interface{}{c.Value, c.ID}
+}
+
+// The isBackward() method reports whether the current cursor fetches the page before
+// its position.
+func (f Filters) isBackward() bool {
+	if !f.CursorMode || f.Cursor == "" {
+		return false
+	}
+	c, _ := decodeCursor(f.Cursor)
+	return c.Backward
+}
+
+func reverseDirection(direction string) string {
+	if direction == "ASC" {
+		return "DESC"
+	}
+	return "ASC"
+}
+
+// The cursorMetadata() method builds the metadata for a page fetched in cursor mode.
+// The sortValues and ids hold the sort column value and id of each fetched row, in
+// the order they were returned by the query (that is, reversed for backward cursors),
+// and there should be up to PageSize+1 of them: the extra row only tells us whether
+// there is anything beyond this page. It returns the number of rows the caller should
+// keep.
+func (f Filters) cursorMetadata(sortValues []string, ids []int64) (Metadata, int) {
+	metadata := Metadata{PageSize: f.PageSize}
+	var c cursor
+	if f.Cursor != "" {
+		c, _ = decodeCursor(f.Cursor)
+	}
+	more := len(ids) > f.PageSize
+	count := len(ids)
+	if more {
+		count = f.PageSize
+	}
+	if count == 0 {
+		return metadata, 0
+	}
+	// Work out which fetched rows are the first and last on the page as the client
+	// will see it.
+	first, last := 0, count-1
+	if c.Backward {
+		first, last = last, first
+	}
+	next := cursor{Sort: f.Sort, Value: sortValues[last], ID: ids[last]}
+	prev := cursor{Sort: f.Sort, Value: sortValues[first], ID: ids[first], Backward: true}
+	switch {
+	case c.Backward:
+		// We came here from a later page, so there is always a next page.
+		metadata.NextCursor = next.encode()
+		if more {
+			metadata.PrevCursor = prev.encode()
+		}
+	default:
+		if more {
+			metadata.NextCursor = next.encode()
+		}
+		if f.Cursor != "" {
+			metadata.PrevCursor = prev.encode()
+		}
+	}
+	return metadata, count
+}
+
 func ValidateFilters(v *validator.Validator, f Filters) {
 	// Check that the page and page_size parameters contain sensible values.
 	v.Check(f.Page > 0, "page", "must be greater than zero")
@@ -49,15 +181,27 @@ func ValidateFilters(v *validator.Validator, f Filters) {
 	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
 	// Check that the sort parameter matches a value in the safelist.
 	v.Check(validator.In(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+	// A cursor is only valid for the sort order it was generated with.
+	if f.CursorMode && f.Cursor != "" {
+		c, err := decodeCursor(f.Cursor)
+		v.Check(err == nil, "cursor", "invalid cursor")
+		v.Check(err != nil || c.Sort == f.Sort, "cursor", "does not match the sort parameter")
+		if bits, ok := f.IntegerSorts[strings.TrimPrefix(c.Sort, "-")]; ok {
+			_, err := strconv.ParseInt(c.Value, 10, bits)
+			v.Check(err == nil, "cursor", "invalid cursor")
+		}
+	}
 }
 
 // Define a new Metadata struct for holding the pagination metadata.
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+	PrevCursor   string `json:"prev_cursor,omitempty"`
 }
 
 // The calculateMetadata() function calculates the appropriate pagination metadata
@@ -0,0 +1,154 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Define constants for the gift statuses. These must be kept in sync with the
+// gifts_status_check constraint in the database.
+const (
+	StatusNotReady  = "not-ready"
+	StatusInProcess = "in-process"
+	StatusReady     = "ready"
+)
+
+// GiftStatuses holds every status a gift can be in, in lifecycle order.
+var GiftStatuses = []string{StatusNotReady, StatusInProcess, StatusReady}
+
+// ErrInvalidTransition is returned when a client asks for a status change which isn't
+// allowed by the gift lifecycle (for example, from "ready" back to "not-ready").
+var ErrInvalidTransition = errors.New("invalid status transition")
+
+// statusTransitions maps each status to the statuses a gift is allowed to move to
+// from it. A gift can be picked up and put back down while it is being worked on,
+// but once it is ready it stays ready.
+var statusTransitions = map[string][]string{
+	StatusNotReady:  {StatusInProcess},
+	StatusInProcess: {StatusNotReady, StatusReady},
+	StatusReady:     {},
+}
+
+// CanTransition returns true if a gift may move directly from one status to another.
+func CanTransition(from, to string) bool {
+	for _, allowed := range statusTransitions[from] {
+		if to == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// A GiftStatusChange is a single entry in the status history of a gift. ChangedBy is
+// a pointer so that we can represent changes made by a user who has since been
+// deleted (the foreign key is set to NULL in that case).
+type GiftStatusChange struct {
+	ID         int64     `json:"id"`
+	GiftID     int64     `json:"gift_id"`
+	FromStatus string    `json:"from_status"`
+	ToStatus   string    `json:"to_status"`
+	ChangedBy  *int64    `json:"changed_by"`
+	ChangedAt  time.Time `json:"changed_at"`
+}
+
+// Define the GiftStatusModel type.
+type GiftStatusModel struct {
+	DB *sql.DB
+}
+
+// Transition() moves the gift to a new status and records the change in the
+// gift_status_history table. Both statements run in a single transaction so that the
+// history can never get out of step with the gifts table. Like GiftModel.Update() we
+// check against the version (and the current status) and return ErrEditConflict if
+// the gift was changed by someone else in the meantime.
+func (m GiftStatusModel) Transition(gift *Gift, to string, userID int64) (*GiftStatusChange, error) {
+	if !CanTransition(gift.Status, to) {
+		return nil, ErrInvalidTransition
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Calling Rollback() after a successful Commit() is a no-op, so it is safe to
+	// defer it here.
+	defer tx.Rollback()
+
+	query := `
+UPDATE gifts
+SET status = $1, version = version + 1
+WHERE id = $2 AND version = $3 AND status = $4
+RETURNING version`
+	var version int32
+	err = tx.QueryRowContext(ctx, query, to, gift.ID, gift.Version, gift.Status).Scan(&version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrEditConflict
+		default:
+			return nil, err
+		}
+	}
+
+	change := &GiftStatusChange{
+		GiftID:     gift.ID,
+		FromStatus: gift.Status,
+		ToStatus:   to,
+		ChangedBy:  &userID,
+	}
+	query = `
+INSERT INTO gift_status_history (gift_id, from_status, to_status, changed_by)
+VALUES ($1, $2, $3, $4)
+RETURNING id, changed_at`
+	err = tx.QueryRowContext(ctx, query, change.GiftID, change.FromStatus, change.ToStatus, userID).Scan(&change.ID, &change.ChangedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	// Only update the in-memory gift once the transaction has been committed.
+	gift.Status = to
+	gift.Version = version
+	return change, nil
+}
+
+// GetAllForGift() returns the status history for a specific gift, oldest first.
+func (m GiftStatusModel) GetAllForGift(giftID int64) ([]*GiftStatusChange, error) {
+	query := `
+SELECT id, gift_id, from_status, to_status, changed_by, changed_at
+FROM gift_status_history
+WHERE gift_id = $1
+ORDER BY changed_at ASC, id ASC`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, giftID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	history := []*GiftStatusChange{}
+	for rows.Next() {
+		var change GiftStatusChange
+		err := rows.Scan(
+			&change.ID,
+			&change.GiftID,
+			&change.FromStatus,
+			&change.ToStatus,
+			&change.ChangedBy,
+			&change.ChangedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, &change)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
@@ -5,7 +5,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"personalized_gifts.sanzhar.net/internal/validator"
 	"time"
 )
@@ -14,17 +14,50 @@ import (
 // JSON-encoded output.
 
 type Gift struct {
-	ID          int64     `json:"id"`
-	CreatedAt   time.Time `json:"-"`
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	Superiority string    `json:"superiority"`
-	Status      string    `json:"status"`
-	Category    string    `json:"category"`
-	Version     int32     `json:"version"`
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"-"`
+	Title       string      `json:"title"`
+	Description string      `json:"description"`
+	Superiority string      `json:"superiority"`
+	Status      string      `json:"status"`
+	Category    string      `json:"category"` // The category slug.
+	CategoryID  int64       `json:"category_id"`
+	Preparation Preparation `json:"preparation,omitempty"`
+	Tags        []string    `json:"tags"`
+	// CreatedBy is the ID of the user who created the gift. It is nil for gifts
+	// created before we recorded owners, or whose owner has been deleted.
+	CreatedBy *int64 `json:"created_by"`
+	// BasePrice is the price set for the gift, and Price is what it actually costs
+	// once the multiplier for its superiority tier has been applied.
+	BasePrice Price `json:"base_price"`
+	Price     Price `json:"price"`
+	Version   int32 `json:"version"`
+	// Images are loaded separately from the gift itself, see GiftImageModel.
+	Images []*GiftImage `json:"images,omitempty"`
+	// Highlights is only set on the results of a full-text search.
+	Highlights *Highlights `json:"highlights,omitempty"`
 }
 
+// Highlights holds snippets of a gift's title and description with the words that
+// matched a search wrapped in <b></b> tags. The rest of the text is HTML-escaped.
+type Highlights struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+// ValidateGift checks a new gift. Gifts being updated are checked with
+// ValidateGiftDetails instead, plus ValidatePreparation and ValidatePrice for the
+// fields being changed.
 func ValidateGift(v *validator.Validator, gift *Gift) {
+	ValidateGiftDetails(v, gift)
+	ValidatePreparation(v, gift.Preparation)
+	ValidatePrice(v, "base_price", gift.BasePrice)
+}
+
+// ValidateGiftDetails checks everything about a gift except its preparation time and
+// price. Gifts created before those were recorded have zeros for them, which aren't
+// valid, so they are only checked when they're set.
+func ValidateGiftDetails(v *validator.Validator, gift *Gift) {
 	v.Check(gift.Title != "", "title", "must be provided")
 	v.Check(len(gift.Title) <= 500, "title", "must not be more than 500 bytes long")
 
@@ -32,13 +65,110 @@ func ValidateGift(v *validator.Validator, gift *Gift) {
 	v.Check(len(gift.Description) <= 1000, "description", "must not be more than 1000 bytes long")
 
 	v.Check(gift.Superiority != "", "superiority", "must be provided")
+	v.Check(validator.In(gift.Superiority, GiftSuperiorities...), "superiority", "must be one of silver, gold or diamond")
 	v.Check(gift.Status != "", "status", "must be provided")
-	v.Check(gift.Category != "", "category", "must be provided")
+	v.Check(validator.In(gift.Status, GiftStatuses...), "status", "must be one of not-ready, in-process or ready")
+	v.Check(gift.CategoryID > 0, "category", "must be provided")
+
+	v.Check(len(gift.Tags) <= 10, "tags", "must not contain more than 10 tags")
+	// Note that we're using the Unique helper in the line below to check that all
+	// values in the gift.Tags slice are unique.
+	v.Check(validator.Unique(gift.Tags), "tags", "must not contain duplicate values")
+	for _, tag := range gift.Tags {
+		v.Check(len(tag) <= 50, "tags", "must not contain tags more than 50 bytes long")
+		v.Check(validator.Matches(tag, validator.SlugRX), "tags", "must only contain lowercase letters, digits and single hyphens")
+	}
+}
+
+func ValidatePreparation(v *validator.Validator, preparation Preparation) {
+	v.Check(preparation != 0, "preparation", "must be provided")
+	v.Check(preparation > 0, "preparation", "must be a positive integer")
+	v.Check(preparation <= 10_080, "preparation", "must not be more than one week")
+}
+
+// GiftSuperiorities holds the allowed superiority tiers. These must be kept in sync
+// with the gifts_superiority_check constraint in the database.
+var GiftSuperiorities = []string{"silver", "gold", "diamond"}
+
+// GiftQuery holds the values that GET /v1/gifts can filter on. Empty slices and zero
+// values mean that particular filter is not applied.
+type GiftQuery struct {
+	Title          string
+	Search         string
+	Statuses       []string
+	Superiorities  []string
+	Categories     []string
+	MinPreparation int
+	MaxPreparation int
+	// MinPrice and MaxPrice are in minor units of Currency. When either is set, only
+	// gifts priced in that currency are returned, as prices in different currencies
+	// can't be compared.
+	MinPrice int64
+	MaxPrice int64
+	Currency string
+	// AllTags matches gifts which have every one of the tags, and AnyTags gifts which
+	// have at least one of them.
+	AllTags []string
+	AnyTags []string
+	// CreatedBy only matches gifts created by that user, when it isn't zero.
+	CreatedBy int64
+}
+
+func ValidateGiftQuery(v *validator.Validator, q GiftQuery) {
+	for _, status := range q.Statuses {
+		v.Check(validator.In(status, GiftStatuses...), "status", "must only contain not-ready, in-process or ready")
+	}
+	for _, superiority := range q.Superiorities {
+		v.Check(validator.In(superiority, GiftSuperiorities...), "superiority", "must only contain silver, gold or diamond")
+	}
+	for _, category := range q.Categories {
+		v.Check(validator.Matches(category, validator.SlugRX), "category", "must only contain category slugs")
+	}
+	v.Check(q.MinPreparation >= 0, "min_preparation", "must not be negative")
+	v.Check(q.MaxPreparation >= 0, "max_preparation", "must not be negative")
+	v.Check(q.MaxPreparation == 0 || q.MinPreparation <= q.MaxPreparation, "max_preparation", "must not be less than min_preparation")
+	_, ok := CurrencyExponents[q.Currency]
+	v.Check(q.Currency == "" || ok, "currency", "must be a supported ISO 4217 currency code")
+	v.Check(q.MinPrice >= 0, "min_price", "must not be negative")
+	v.Check(q.MaxPrice >= 0, "max_price", "must not be negative")
+	v.Check(q.MaxPrice == 0 || q.MinPrice <= q.MaxPrice, "max_price", "must not be less than min_price")
+	for _, tag := range q.AllTags {
+		v.Check(validator.Matches(tag, validator.SlugRX), "tags", "must only contain valid tags")
+	}
+	for _, tag := range q.AnyTags {
+		v.Check(validator.Matches(tag, validator.SlugRX), "tags_any", "must only contain valid tags")
+	}
 }
 
 // Define a MovieModel struct type which wraps a sql.DB connection pool.
 type GiftModel struct {
 	DB *sql.DB
+	// SearchConfig is the PostgreSQL text search configuration (like "english") used
+	// for stemming in full-text searches. It is interpolated into the SQL, so it must
+	// only ever come from trusted configuration.
+	SearchConfig string
+}
+
+// searchDocument() returns the SQL expression for the weighted search document of a
+// gift. Matches in the title (weight A) rank higher than matches in the description
+// (weight B). This must match the gifts_search_idx expression for the index to be
+// used.
+func (m GiftModel) searchDocument() string {
+	return fmt.Sprintf("(setweight(to_tsvector('%[1]s', title), 'A') || setweight(to_tsvector('%[1]s', description), 'B'))", m.searchConfig())
+}
+
+// htmlEscape() returns an SQL expression which HTML-escapes the column. The highlights
+// are built from escaped text, so that the only markup in them is our <b></b> tags
+// and clients can render them as HTML safely.
+func htmlEscape(column string) string {
+	return fmt.Sprintf(`replace(replace(replace(replace(replace(%s, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&quot;'), '''', '&#39;')`, column)
+}
+
+func (m GiftModel) searchConfig() string {
+	if m.SearchConfig == "" {
+		return "simple"
+	}
+	return m.SearchConfig
 }
 
 // The Insert() method accepts a pointer to a movie struct, which should contain the
@@ -47,16 +177,17 @@ func (m GiftModel) Insert(gift *Gift) error {
 	// Define the SQL query for inserting a new record in the gifts table and returning
 	// the system-generated data.
 	query := `
-        INSERT INTO gifts (title, description, superiority, status, category)
-        VALUES ($1, $2, $3, $4, $5)
-        RETURNING id, created_at, version`
+        INSERT INTO gifts (title, description, superiority, status, category_id, preparation, price_amount, price_currency, tags, created_by)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+        RETURNING id, created_at, version, ` + effectivePrice
 	// Create an args slice containing the values for the placeholder parameters from
 	// the gift struct.
-	args := []interface{}{gift.Title, gift.Description, gift.Superiority, gift.Status, gift.Category}
+	args := []interface{}{gift.Title, gift.Description, gift.Superiority, gift.Status, gift.CategoryID, gift.Preparation, gift.BasePrice.Amount, gift.BasePrice.Currency, pq.Array(gift.Tags), gift.CreatedBy}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&gift.ID, &gift.CreatedAt, &gift.Version)
+	gift.Price.Currency = gift.BasePrice.Currency
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&gift.ID, &gift.CreatedAt, &gift.Version, &gift.Price.Amount)
 }
 
 func (m GiftModel) Get(id int64) (*Gift, error) {
@@ -67,7 +198,7 @@ func (m GiftModel) Get(id int64) (*Gift, error) {
 
 	// Define the SQL query for retrieving the movie data.
 	query := `
-        SELECT  id, created_at, title, description, superiority, status, category, version
+        SELECT  id, created_at, title, description, superiority, status, category_id, ` + giftCategorySlug + `, preparation, tags, created_by, price_amount, price_currency, ` + effectivePrice + `, version
         FROM gifts
         WHERE id = $1`
 	// Declare a Movie struct to hold the data returned by the query.
@@ -85,7 +216,14 @@ func (m GiftModel) Get(id int64) (*Gift, error) {
 		&gift.Description,
 		&gift.Superiority,
 		&gift.Status,
+		&gift.CategoryID,
 		&gift.Category,
+		&gift.Preparation,
+		pq.Array(&gift.Tags),
+		&gift.CreatedBy,
+		&gift.BasePrice.Amount,
+		&gift.BasePrice.Currency,
+		&gift.Price.Amount,
 		&gift.Version,
 	)
 	// Handle any errors. If there was no matching movie found, Scan() will return
@@ -99,6 +237,7 @@ func (m GiftModel) Get(id int64) (*Gift, error) {
 			return nil, err
 		}
 	}
+	gift.Price.Currency = gift.BasePrice.Currency
 	// Otherwise, return a pointer to the Movie struct.
 	return &gift, nil
 }
@@ -108,16 +247,21 @@ func (m GiftModel) Update(gift *Gift) error {
 	// number.
 	query := `
         UPDATE gifts
-        SET title = $1, description = $2, superiority = $3, status = $4, category =$5, version = version + 1
-        WHERE id = $6 AND version = $7
-        RETURNING version`
+        SET title = $1, description = $2, superiority = $3, status = $4, category_id = $5, preparation = $6,
+            price_amount = $7, price_currency = $8, tags = $9, version = version + 1
+        WHERE id = $10 AND version = $11
+        RETURNING version, ` + effectivePrice
 	// Create an args slice containing the values for the placeholder parameters.
 	args := []interface{}{
 		gift.Title,
 		gift.Description,
 		gift.Superiority,
 		gift.Status,
-		gift.Category,
+		gift.CategoryID,
+		gift.Preparation,
+		gift.BasePrice.Amount,
+		gift.BasePrice.Currency,
+		pq.Array(gift.Tags),
 		gift.ID,
 		gift.Version,
 	}
@@ -125,7 +269,8 @@ func (m GiftModel) Update(gift *Gift) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&gift.Version)
+	gift.Price.Currency = gift.BasePrice.Currency
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&gift.Version, &gift.Price.Amount)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -137,6 +282,31 @@ func (m GiftModel) Update(gift *Gift) error {
 	return nil
 }
 
+// GetOwner() returns the ID of the user who created a gift, which is nil if nobody
+// owns it. It's cheaper than Get() when that's all we need.
+func (m GiftModel) GetOwner(id int64) (*int64, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+SELECT created_by
+FROM gifts
+WHERE id = $1`
+	var owner *int64
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&owner)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return owner, nil
+}
+
 func (m GiftModel) Delete(id int64) error {
 	// Return an ErrRecordNotFound error if the movie ID is less than 1.
 	if id < 1 {
@@ -169,19 +339,90 @@ func (m GiftModel) Delete(id int64) error {
 	return nil
 }
 
-func (m GiftModel) GetAll(title string, filters Filters) ([]*Gift, Metadata, error) {
+// GetAll() returns the gifts matching every filter in the GiftQuery. Each of the
+// status and superiority filters matches if the column equals any of the provided
+// values, the category filter matches gifts in any of the given categories or their
+// subcategories, and each is skipped entirely when no values were provided. Because the
+// count(*) OVER() window is evaluated after the WHERE clause, the total in the
+// returned Metadata reflects the filtered set.
+//
+// In cursor mode the page is selected with a keyset condition on the sort column and
+// id instead of an OFFSET, which keeps deep pages fast and stops rows from being
+// skipped or repeated when gifts are inserted mid-scroll. We fetch one extra row to
+// find out whether there is another page, and select a constant 0 in place of the
+// count(*) OVER() window, which would have to read the whole filtered set.
+func (m GiftModel) GetAll(q GiftQuery, filters Filters) ([]*Gift, Metadata, error) {
+	args := []interface{}{
+		q.Title,
+		pq.Array(q.Statuses),
+		pq.Array(q.Superiorities),
+		pq.Array(q.Categories),
+		q.MinPreparation,
+		q.MaxPreparation,
+		q.Search,
+		q.MinPrice,
+		q.MaxPrice,
+		q.Currency,
+		pq.Array(q.AllTags),
+		pq.Array(q.AnyTags),
+		q.CreatedBy,
+	}
+	document := m.searchDocument()
+	tsquery := fmt.Sprintf("websearch_to_tsquery('%s', $7)", m.searchConfig())
+	rank := fmt.Sprintf("ts_rank(%s, %s)", document, tsquery)
+	// The "relevance" sort isn't a real column, so we order by the search rank (best
+	// match first) instead.
+	sortColumn := filters.sortColumn()
+	switch sortColumn {
+	case "relevance":
+		sortColumn = rank
+	case "price":
+		sortColumn = effectivePrice
+	case "category":
+		sortColumn = giftCategorySlug
+	}
+	order := fmt.Sprintf("%s %s, id ASC", sortColumn, filters.sortDirection())
+	if filters.sortColumn() == "relevance" {
+		order = rank + " DESC, id ASC"
+	}
+	total := "count(*) OVER()"
+	keyset := "TRUE"
+	limit, offset := filters.limit(), filters.offset()
+	if filters.CursorMode {
+		total = "0"
+		var keysetArgs []interface{}
+		keyset, order, keysetArgs = filters.keyset(sortColumn, len(args)+1)
+		args = append(args, keysetArgs...)
+		limit, offset = filters.limit()+1, 0
+	}
+	args = append(args, limit, offset)
+
 	query := fmt.Sprintf(`
-	SELECT count(*) OVER(), id, created_at, title, description, superiority, status, category, version
+	SELECT %[14]s, %[1]s::text, id, created_at, title, description, superiority, status, category_id, %[10]s, preparation, tags, created_by,
+	price_amount, price_currency, %[9]s, version,
+	CASE WHEN $7 = '' THEN '' ELSE ts_headline('%[2]s', %[12]s, %[3]s) END,
+	CASE WHEN $7 = '' THEN '' ELSE ts_headline('%[2]s', %[13]s, %[3]s) END
 	FROM gifts
 	WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-    ORDER BY %s %s, id ASC
-    LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+	AND (status = ANY($2) OR cardinality($2::text[]) = 0)
+	AND (superiority = ANY($3) OR cardinality($3::text[]) = 0)
+	AND %[11]s
+	AND (preparation >= $5 OR $5 = 0)
+	AND (preparation <= $6 OR $6 = 0)
+	AND (%[4]s @@ %[3]s OR $7 = '')
+	AND (%[9]s >= $8 OR $8 = 0)
+	AND (%[9]s <= $9 OR $9 = 0)
+	AND (price_currency = $10 OR $10 = '')
+	AND (tags @> $11 OR cardinality($11::text[]) = 0)
+	AND (tags && $12 OR cardinality($12::text[]) = 0)
+	AND (created_by = $13 OR $13 = 0)
+	AND %[5]s
+    ORDER BY %[6]s
+    LIMIT $%[7]d OFFSET $%[8]d`, sortColumn, m.searchConfig(), tsquery, document, keyset, order, len(args)-1, len(args), effectivePrice, giftCategorySlug, giftCategoryTree, htmlEscape("title"), htmlEscape("description"), total)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	args := []interface{}{title, filters.limit(), filters.offset()}
-
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
@@ -190,33 +431,100 @@ func (m GiftModel) GetAll(title string, filters Filters) ([]*Gift, Metadata, err
 	defer rows.Close()
 	totalRecords := 0
 	gifts := []*Gift{}
+	sortValues := []string{}
+	ids := []int64{}
 
 	for rows.Next() {
 		var gift Gift
+		var sortValue string
+		var highlights Highlights
 
 		err := rows.Scan(
 			&totalRecords, // Извлекаем общее количество записей
+			&sortValue,
 			&gift.ID,
 			&gift.CreatedAt,
 			&gift.Title,
 			&gift.Description,
 			&gift.Superiority,
 			&gift.Status,
+			&gift.CategoryID,
 			&gift.Category,
+			&gift.Preparation,
+			pq.Array(&gift.Tags),
+			&gift.CreatedBy,
+			&gift.BasePrice.Amount,
+			&gift.BasePrice.Currency,
+			&gift.Price.Amount,
 			&gift.Version,
+			&highlights.Title,
+			&highlights.Description,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
+		gift.Price.Currency = gift.BasePrice.Currency
+		if q.Search != "" {
+			gift.Highlights = &highlights
+		}
 		gifts = append(gifts, &gift)
+		sortValues = append(sortValues, sortValue)
+		ids = append(ids, gift.ID)
 	}
 
 	if err = rows.Err(); err != nil {
 		return nil, Metadata{}, err
 	}
+	if filters.CursorMode {
+		metadata, count := filters.cursorMetadata(sortValues, ids)
+		gifts = gifts[:count]
+		// Rows for a backward cursor come back in reverse order, so flip them round
+		// before returning them to the client.
+		if filters.isBackward() {
+			for i, j := 0, len(gifts)-1; i < j; i, j = i+1, j-1 {
+				gifts[i], gifts[j] = gifts[j], gifts[i]
+			}
+		}
+		return gifts, metadata, nil
+	}
 	// Generate a Metadata struct, passing in the total record count and pagination
 	// parameters from the client.
 	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
 	// Include the metadata struct when returning.
 	return gifts, metadata, nil
 }
+
+// A TagCount holds a tag and the number of gifts which use it.
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// GetTagCounts() returns every tag in use, most used first.
+func (m GiftModel) GetTagCounts() ([]*TagCount, error) {
+	query := `
+	SELECT tag, count(*)
+	FROM gifts, unnest(tags) AS tag
+	GROUP BY tag
+	ORDER BY count(*) DESC, tag ASC`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tags := []*TagCount{}
+	for rows.Next() {
+		var tag TagCount
+		err := rows.Scan(&tag.Tag, &tag.Count)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, &tag)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
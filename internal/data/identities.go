@@ -0,0 +1,116 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// An OIDCState is what we need to remember about an OpenID Connect login between
+// sending the user to the provider and them coming back. Plaintext is the state
+// parameter itself, which is only set when the state is created.
+type OIDCState struct {
+	Plaintext    string
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	Expiry       time.Time
+}
+
+// Define the IdentityModel type.
+type IdentityModel struct {
+	DB *sql.DB
+}
+
+// NewState() creates and saves a new state for a login with the provider. It also
+// clears out expired states, which are left behind by logins that were never finished.
+func (m IdentityModel) NewState(provider, nonce, codeVerifier string, ttl time.Duration) (*OIDCState, error) {
+	token, err := generateToken(0, ttl, "")
+	if err != nil {
+		return nil, err
+	}
+	state := &OIDCState{
+		Plaintext:    token.Plaintext,
+		Provider:     provider,
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		Expiry:       token.Expiry,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err = m.DB.ExecContext(ctx, `DELETE FROM oidc_states WHERE expiry <= NOW()`)
+	if err != nil {
+		return nil, err
+	}
+	query := `
+INSERT INTO oidc_states (hash, provider, nonce, code_verifier, expiry)
+VALUES ($1, $2, $3, $4, $5)`
+	_, err = m.DB.ExecContext(ctx, query, token.Hash, provider, nonce, codeVerifier, state.Expiry)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// TakeState() returns the unexpired state with the given plaintext for the provider,
+// and deletes it so that it can only be used once.
+func (m IdentityModel) TakeState(provider, plaintext string) (*OIDCState, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+	query := `
+DELETE FROM oidc_states
+WHERE hash = $1 AND provider = $2 AND expiry > $3
+RETURNING provider, nonce, code_verifier, expiry`
+	state := OIDCState{Plaintext: plaintext}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, hash[:], provider, time.Now()).Scan(
+		&state.Provider,
+		&state.Nonce,
+		&state.CodeVerifier,
+		&state.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &state, nil
+}
+
+// GetUserID() returns the ID of the user linked to the provider account.
+func (m IdentityModel) GetUserID(provider, subject string) (int64, error) {
+	query := `
+SELECT user_id
+FROM user_identities
+WHERE provider = $1 AND subject = $2`
+	var userID int64
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, provider, subject).Scan(&userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+	return userID, nil
+}
+
+// Link() links a provider account to a user, so that they can sign in with it.
+func (m IdentityModel) Link(userID int64, provider, subject, email string) error {
+	query := `
+INSERT INTO user_identities (provider, subject, user_id, email)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (provider, subject) DO NOTHING`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, provider, subject, userID, email)
+	return err
+}
@@ -0,0 +1,243 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"personalized_gifts.sanzhar.net/internal/validator"
+	"time"
+)
+
+// Define the image content types that we accept for upload, and the file extension
+// that we store each of them under.
+var ImageContentTypes = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+}
+
+// A GiftImage holds the details of an uploaded image. The files themselves live in
+// the storage backend under StoragePrefix; the URL and Thumbnails fields are filled in
+// by the handlers, because only they know where the storage is served from.
+type GiftImage struct {
+	ID            int64             `json:"id"`
+	GiftID        int64             `json:"-"`
+	StoragePrefix string            `json:"-"`
+	ContentType   string            `json:"content_type"`
+	Position      int32             `json:"position"`
+	Primary       bool              `json:"primary"`
+	CreatedAt     time.Time         `json:"created_at"`
+	URL           string            `json:"url"`
+	Thumbnails    map[string]string `json:"thumbnails"`
+}
+
+// OriginalKey returns the storage key of the original uploaded file.
+func (i *GiftImage) OriginalKey() string {
+	return i.StoragePrefix + "/original." + ImageContentTypes[i.ContentType]
+}
+
+// ThumbnailKey returns the storage key of the thumbnail with the given size name.
+// Thumbnails of JPEGs are stored as JPEGs, and everything else as PNG so that
+// transparency is kept.
+func (i *GiftImage) ThumbnailKey(size string) string {
+	if i.ContentType == "image/jpeg" {
+		return i.StoragePrefix + "/" + size + ".jpg"
+	}
+	return i.StoragePrefix + "/" + size + ".png"
+}
+
+func ValidateGiftImage(v *validator.Validator, image *GiftImage) {
+	v.Check(image.Position > 0, "position", "must be greater than zero")
+	v.Check(image.Position <= 1000, "position", "must not be more than 1000")
+}
+
+// Define the GiftImageModel type.
+type GiftImageModel struct {
+	DB *sql.DB
+}
+
+// Insert() adds a new image at the end of the gift's list. The first image uploaded
+// for a gift automatically becomes its primary image. The gift's row is locked first,
+// so that concurrent uploads for the same gift take turns; otherwise two first uploads
+// could both try to become the primary image.
+func (m GiftImageModel) Insert(image *GiftImage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var giftID int64
+	err = tx.QueryRowContext(ctx, `SELECT id FROM gifts WHERE id = $1 FOR UPDATE`, image.GiftID).Scan(&giftID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	query := `
+INSERT INTO gift_images (gift_id, storage_prefix, content_type, position, is_primary)
+SELECT $1, $2, $3, COALESCE(MAX(position), 0) + 1, COUNT(*) = 0
+FROM gift_images
+WHERE gift_id = $1
+RETURNING id, position, is_primary, created_at`
+	args := []interface{}{image.GiftID, image.StoragePrefix, image.ContentType}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&image.ID, &image.Position, &image.Primary, &image.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m GiftImageModel) Get(giftID, id int64) (*GiftImage, error) {
+	if giftID < 1 || id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+SELECT id, gift_id, storage_prefix, content_type, position, is_primary, created_at
+FROM gift_images
+WHERE gift_id = $1 AND id = $2`
+	var image GiftImage
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, giftID, id).Scan(
+		&image.ID,
+		&image.GiftID,
+		&image.StoragePrefix,
+		&image.ContentType,
+		&image.Position,
+		&image.Primary,
+		&image.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &image, nil
+}
+
+// GetAllForGifts() returns the images for several gifts at once, keyed by gift ID and
+// in display order. This lets us attach images to a whole page of gifts with a single
+// query.
+func (m GiftImageModel) GetAllForGifts(giftIDs []int64) (map[int64][]*GiftImage, error) {
+	query := `
+SELECT id, gift_id, storage_prefix, content_type, position, is_primary, created_at
+FROM gift_images
+WHERE gift_id = ANY($1)
+ORDER BY gift_id, position, id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(giftIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	images := make(map[int64][]*GiftImage)
+	for rows.Next() {
+		var image GiftImage
+		err := rows.Scan(
+			&image.ID,
+			&image.GiftID,
+			&image.StoragePrefix,
+			&image.ContentType,
+			&image.Position,
+			&image.Primary,
+			&image.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		images[image.GiftID] = append(images[image.GiftID], &image)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// Update() saves the position and primary flag of an image. If the image is being made
+// the primary one, the flag is cleared on the gift's other images in the same
+// transaction, so the gift_images_primary_idx constraint always holds.
+func (m GiftImageModel) Update(image *GiftImage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if image.Primary {
+		query := `
+UPDATE gift_images
+SET is_primary = false
+WHERE gift_id = $1 AND id <> $2 AND is_primary`
+		_, err = tx.ExecContext(ctx, query, image.GiftID, image.ID)
+		if err != nil {
+			return err
+		}
+	}
+	query := `
+UPDATE gift_images
+SET position = $1, is_primary = $2
+WHERE gift_id = $3 AND id = $4`
+	result, err := tx.ExecContext(ctx, query, image.Position, image.Primary, image.GiftID, image.ID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return tx.Commit()
+}
+
+// Delete() removes an image. If it was the primary image, the next image in display
+// order (if there is one) is promoted in its place.
+func (m GiftImageModel) Delete(giftID, id int64) error {
+	if giftID < 1 || id < 1 {
+		return ErrRecordNotFound
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := `
+DELETE FROM gift_images
+WHERE gift_id = $1 AND id = $2
+RETURNING is_primary`
+	var wasPrimary bool
+	err = tx.QueryRowContext(ctx, query, giftID, id).Scan(&wasPrimary)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	if wasPrimary {
+		query = `
+UPDATE gift_images
+SET is_primary = true
+WHERE id = (SELECT id FROM gift_images WHERE gift_id = $1 ORDER BY position, id LIMIT 1)`
+		_, err = tx.ExecContext(ctx, query, giftID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,161 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// LoginStatus summarizes the recent failed logins for an email address and for the IP
+// address that a login attempt is coming from.
+type LoginStatus struct {
+	EmailFailures int
+	// LastEmailFailure is the time of the most recent failure for the email address.
+	LastEmailFailure time.Time
+	IPFailures       int
+	// FirstIPFailure is the time of the oldest failure from the IP address which still
+	// counts.
+	FirstIPFailure time.Time
+	// LockedUntil is nil unless logins for the email address are locked.
+	LockedUntil *time.Time
+	// AttemptID is the ID of the attempt recorded by RecordAttempt(), or zero if it
+	// wasn't recorded.
+	AttemptID int64
+}
+
+// Define the LoginModel type.
+type LoginModel struct {
+	DB *sql.DB
+}
+
+// RecordAttempt() returns the failed logins for the email and IP addresses since the
+// given time, along with any active lock on the email address, and then records this
+// attempt as a failure unless the email address is locked. Failures from before the
+// given time, which no longer count for anything, are cleared out.
+//
+// Recording the attempt before it's made, under a lock on the email and IP addresses,
+// means that concurrent attempts see each other: a burst of guesses can't all get
+// through on the same count. An attempt which succeeds is cleared with Clear(), and
+// one which isn't allowed to go ahead after all with DeleteAttempt().
+func (m LoginModel) RecordAttempt(email, ip string, since time.Time) (*LoginStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	// Always lock the email before the IP address, so that attempts can't deadlock.
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(1, hashtext(lower($1)))`, email)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(2, hashtext($1))`, ip)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM login_failures WHERE created_at <= $1`, since)
+	if err != nil {
+		return nil, err
+	}
+	query := `
+SELECT
+	(SELECT count(*) FROM login_failures WHERE email = $1),
+	(SELECT max(created_at) FROM login_failures WHERE email = $1),
+	(SELECT count(*) FROM login_failures WHERE ip = $2),
+	(SELECT min(created_at) FROM login_failures WHERE ip = $2),
+	(SELECT locked_until FROM login_locks WHERE email = $1 AND locked_until > NOW())`
+	var status LoginStatus
+	var lastEmailFailure, firstIPFailure sql.NullTime
+	err = tx.QueryRowContext(ctx, query, email, ip).Scan(
+		&status.EmailFailures,
+		&lastEmailFailure,
+		&status.IPFailures,
+		&firstIPFailure,
+		&status.LockedUntil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	status.LastEmailFailure = lastEmailFailure.Time
+	status.FirstIPFailure = firstIPFailure.Time
+	if status.LockedUntil == nil {
+		query = `
+INSERT INTO login_failures (email, ip)
+VALUES ($1, $2)
+RETURNING id`
+		err = tx.QueryRowContext(ctx, query, email, ip).Scan(&status.AttemptID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// DeleteAttempt() removes an attempt recorded by RecordAttempt().
+func (m LoginModel) DeleteAttempt(id int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM login_failures WHERE id = $1`, id)
+	return err
+}
+
+// Lock() stops logins for the email address until the given time.
+func (m LoginModel) Lock(email string, until time.Time) error {
+	query := `
+INSERT INTO login_locks (email, locked_until)
+VALUES ($1, $2)
+ON CONFLICT (email) DO UPDATE SET locked_until = EXCLUDED.locked_until`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, email, until)
+	return err
+}
+
+// Clear() removes the lock and the failed logins for the email address. It is called
+// after a successful login, and when an administrator unlocks an account.
+func (m LoginModel) Clear(email string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, `DELETE FROM login_failures WHERE email = $1`, email)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM login_locks WHERE email = $1`, email)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// LockedUntil() returns when the lock on the email address ends, or nil if logins for
+// it aren't locked.
+func (m LoginModel) LockedUntil(email string) (*time.Time, error) {
+	query := `
+SELECT locked_until
+FROM login_locks
+WHERE email = $1 AND locked_until > NOW()`
+	var lockedUntil time.Time
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, email).Scan(&lockedUntil)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+	return &lockedUntil, nil
+}
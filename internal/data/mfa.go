@@ -0,0 +1,245 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+)
+
+// The number of recovery codes a user gets when they enable two-factor authentication.
+const recoveryCodeCount = 10
+
+var (
+	// ErrTOTPEnabled is returned when starting TOTP enrollment for a user who already
+	// has it enabled.
+	ErrTOTPEnabled = errors.New("totp already enabled")
+	// ErrTOTPNotEnrolled is returned when confirming TOTP enrollment for a user who
+	// hasn't started it.
+	ErrTOTPNotEnrolled = errors.New("totp enrollment not started")
+)
+
+// TOTP is a user's time-based one-time password setup. Secret is nil if the user has
+// never started enrolling, and Enabled is false until they confirm it with a code.
+type TOTP struct {
+	Secret   []byte
+	Enabled  bool
+	LastStep int64
+}
+
+// Define the MFAModel type.
+type MFAModel struct {
+	DB *sql.DB
+}
+
+func (m MFAModel) GetTOTP(userID int64) (*TOTP, error) {
+	query := `
+SELECT totp_secret, totp_enabled, totp_last_step
+FROM users
+WHERE id = $1`
+	var totp TOTP
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&totp.Secret, &totp.Enabled, &totp.LastStep)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &totp, nil
+}
+
+// SetTOTPSecret() starts TOTP enrollment, replacing the secret from any enrollment
+// which wasn't confirmed.
+func (m MFAModel) SetTOTPSecret(userID int64, secret []byte) error {
+	query := `
+UPDATE users
+SET totp_secret = $2, totp_last_step = 0
+WHERE id = $1 AND NOT totp_enabled`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, userID, secret)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrTOTPEnabled
+	}
+	return nil
+}
+
+// EnableTOTP() confirms TOTP enrollment, recording the step of the code that the user
+// confirmed it with, and gives the user a new set of recovery codes.
+func (m MFAModel) EnableTOTP(userID int64, step int64, recoveryCodes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := `
+UPDATE users
+SET totp_enabled = true, totp_last_step = $2
+WHERE id = $1 AND totp_secret IS NOT NULL AND NOT totp_enabled`
+	result, err := tx.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrTOTPNotEnrolled
+	}
+	err = replaceRecoveryCodes(ctx, tx, userID, recoveryCodes)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DisableTOTP() removes the user's TOTP secret and their recovery codes.
+func (m MFAModel) DisableTOTP(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := `
+UPDATE users
+SET totp_secret = NULL, totp_enabled = false, totp_last_step = 0
+WHERE id = $1`
+	_, err = tx.ExecContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep() records that a code from the given time step has been used. It returns
+// false if a code from that step (or a later one) was used already, in which case the
+// code mustn't be accepted again.
+func (m MFAModel) UseTOTPStep(userID int64, step int64) (bool, error) {
+	query := `
+UPDATE users
+SET totp_last_step = $2
+WHERE id = $1 AND totp_last_step < $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+// ReplaceRecoveryCodes() gives the user a new set of recovery codes, so that the old
+// ones stop working.
+func (m MFAModel) ReplaceRecoveryCodes(userID int64, recoveryCodes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = replaceRecoveryCodes(ctx, tx, userID, recoveryCodes)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int64, recoveryCodes []string) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	for _, code := range recoveryCodes {
+		_, err = tx.ExecContext(ctx, `INSERT INTO recovery_codes (user_id, hash) VALUES ($1, $2)`, userID, hashRecoveryCode(code))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseRecoveryCode() marks one of the user's recovery codes as used, returning false if
+// the code is wrong or has been used already.
+func (m MFAModel) UseRecoveryCode(userID int64, code string) (bool, error) {
+	query := `
+UPDATE recovery_codes
+SET used_at = NOW()
+WHERE user_id = $1 AND hash = $2 AND used_at IS NULL`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected > 0, nil
+}
+
+// CountRecoveryCodes() returns how many of the user's recovery codes haven't been used.
+func (m MFAModel) CountRecoveryCodes(userID int64) (int, error) {
+	query := `
+SELECT count(*)
+FROM recovery_codes
+WHERE user_id = $1 AND used_at IS NULL`
+	var count int
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&count)
+	return count, err
+}
+
+// GenerateRecoveryCodes() returns a new set of recovery codes. They look like
+// "k3x7q-m2wpa", and like tokens we only ever store their SHA-256 hashes.
+func GenerateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		randomBytes := make([]byte, 7)
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode() hashes a recovery code, ignoring case, spaces and hyphens so that
+// it doesn't matter how the user types it in.
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
@@ -15,8 +15,19 @@ var (
 // Create a Models struct which wraps the MovieModel. We'll add other models to this,
 // like a UserModel and PermissionModel, as our build progresses.
 type Models struct {
+	APIKeys     APIKeyModel // Add a new APIKeys field.
 	Gifts       GiftModel
+	Statuses    GiftStatusModel // Add a new Statuses field.
+	Images      GiftImageModel  // Add a new Images field.
+	Identities  IdentityModel   // Add a new Identities field.
+	Orders      OrderModel      // Add a new Orders field.
+	Pricing     PricingModel    // Add a new Pricing field.
+	Categories  CategoryModel   // Add a new Categories field.
+	Denylist    DenylistModel   // Add a new Denylist field.
+	Logins      LoginModel      // Add a new Logins field.
+	MFA         MFAModel        // Add a new MFA field.
 	Permissions PermissionModel // Add a new Permissions field.
+	Roles       RoleModel       // Add a new Roles field.
 	Tokens      TokenModel      // Add a new Tokens field
 	Users       UserModel       // Add a new Users field.
 }
@@ -25,8 +36,19 @@ type Models struct {
 // the initialized MovieModel.
 func NewModels(db *sql.DB) Models {
 	return Models{
+		APIKeys:     APIKeyModel{DB: db}, // Initialize a new APIKeyModel instance.
 		Gifts:       GiftModel{DB: db},
+		Statuses:    GiftStatusModel{DB: db}, // Initialize a new GiftStatusModel instance.
+		Images:      GiftImageModel{DB: db},  // Initialize a new GiftImageModel instance.
+		Identities:  IdentityModel{DB: db},   // Initialize a new IdentityModel instance.
+		Orders:      OrderModel{DB: db},      // Initialize a new OrderModel instance.
+		Pricing:     PricingModel{DB: db},    // Initialize a new PricingModel instance.
+		Categories:  CategoryModel{DB: db},   // Initialize a new CategoryModel instance.
+		Denylist:    DenylistModel{DB: db},   // Initialize a new DenylistModel instance.
+		Logins:      LoginModel{DB: db},      // Initialize a new LoginModel instance.
+		MFA:         MFAModel{DB: db},        // Initialize a new MFAModel instance.
 		Permissions: PermissionModel{DB: db}, // Initialize a new PermissionModel instance.
+		Roles:       RoleModel{DB: db},       // Initialize a new RoleModel instance.
 		Tokens:      TokenModel{DB: db},      // Initialize a new TokenModel instance.
 		Users:       UserModel{DB: db},       // Initialize a new UserModel instance.
 
@@ -0,0 +1,23 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Changes to data which the API servers hold in memory are broadcast with PostgreSQL's
+// NOTIFY, so that every server applies them straight away instead of waiting for its
+// copy to expire or be reloaded.
+const (
+	// PermissionsChannel carries the ID of a user whose permissions have changed, or
+	// an empty string for changes which could affect any user.
+	PermissionsChannel = "permissions_changed"
+	// DenylistChannel carries each new JWT revocation, encoded as JSON.
+	DenylistChannel = "jwt_denylist_changed"
+)
+
+// The notify() helper sends a notification to every server listening on the channel.
+func notify(ctx context.Context, db *sql.DB, channel, payload string) error {
+	_, err := db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, channel, payload)
+	return err
+}
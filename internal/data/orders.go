@@ -0,0 +1,280 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"personalized_gifts.sanzhar.net/internal/validator"
+	"strings"
+	"time"
+)
+
+// Define constants for the order statuses. These must be kept in sync with the
+// orders_status_check constraint in the database.
+const (
+	OrderPending   = "pending"
+	OrderConfirmed = "confirmed"
+	OrderShipped   = "shipped"
+	OrderDelivered = "delivered"
+	OrderCancelled = "cancelled"
+)
+
+// OrderStatuses holds every status an order can be in.
+var OrderStatuses = []string{OrderPending, OrderConfirmed, OrderShipped, OrderDelivered, OrderCancelled}
+
+// ErrGiftNotFound is returned when an order refers to a gift which doesn't exist.
+var ErrGiftNotFound = errors.New("gift not found")
+
+// An Order is a request from a user for one or more personalized gifts, all sent to
+// the same recipient.
+type Order struct {
+	ID            int64        `json:"id"`
+	CreatedAt     time.Time    `json:"created_at"`
+	UserID        int64        `json:"user_id"`
+	Status        string       `json:"status"`
+	RecipientName string       `json:"recipient_name"`
+	DeliveryDate  Date         `json:"delivery_date"`
+	GiftMessage   string       `json:"gift_message"`
+	Items         []*OrderItem `json:"items"`
+	Version       int32        `json:"version"`
+}
+
+// An OrderItem is a single gift in an order, along with the text to engrave on it.
+// GiftID is a pointer because the gift may since have been deleted from the catalogue.
+type OrderItem struct {
+	ID            int64  `json:"id"`
+	GiftID        *int64 `json:"gift_id"`
+	Quantity      int32  `json:"quantity"`
+	EngravingText string `json:"engraving_text"`
+}
+
+func ValidateOrder(v *validator.Validator, order *Order) {
+	v.Check(order.RecipientName != "", "recipient_name", "must be provided")
+	v.Check(len(order.RecipientName) <= 500, "recipient_name", "must not be more than 500 bytes long")
+
+	v.Check(!order.DeliveryDate.IsZero(), "delivery_date", "must be provided")
+	v.Check(len(order.GiftMessage) <= 1000, "gift_message", "must not be more than 1000 bytes long")
+	v.Check(validator.In(order.Status, OrderStatuses...), "status", "must be one of pending, confirmed, shipped, delivered or cancelled")
+
+	v.Check(len(order.Items) >= 1, "items", "must contain at least 1 gift")
+	v.Check(len(order.Items) <= 20, "items", "must not contain more than 20 gifts")
+	for i, item := range order.Items {
+		key := fmt.Sprintf("items[%d]", i)
+		v.Check(item.Quantity > 0, key+".quantity", "must be greater than zero")
+		v.Check(item.Quantity <= 100, key+".quantity", "must not be more than 100")
+		v.Check(len(item.EngravingText) <= 200, key+".engraving_text", "must not be more than 200 bytes long")
+	}
+}
+
+// ValidateOrderGifts checks that every item of a new order is for a gift. It isn't
+// part of ValidateOrder, because items of existing orders lose their gift when it's
+// deleted from the catalogue, and those orders must still be updatable.
+func ValidateOrderGifts(v *validator.Validator, order *Order) {
+	for i, item := range order.Items {
+		v.Check(item.GiftID != nil && *item.GiftID > 0, fmt.Sprintf("items[%d].gift_id", i), "must be provided")
+	}
+}
+
+// ValidateDeliveryDate checks that a new delivery date is at least a day away, which
+// gives the workshop time to engrave and send the order.
+func ValidateDeliveryDate(v *validator.Validator, date Date) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	v.Check(date.After(today), "delivery_date", "must be in the future")
+}
+
+// Define the OrderModel type.
+type OrderModel struct {
+	DB *sql.DB
+}
+
+// Insert() creates the order and all of its items in a single transaction.
+func (m OrderModel) Insert(order *Order) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+INSERT INTO orders (user_id, status, recipient_name, delivery_date, gift_message)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING id, created_at, version`
+	args := []interface{}{order.UserID, order.Status, order.RecipientName, order.DeliveryDate, order.GiftMessage}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&order.ID, &order.CreatedAt, &order.Version)
+	if err != nil {
+		return err
+	}
+
+	query = `
+INSERT INTO order_items (order_id, gift_id, quantity, engraving_text)
+VALUES ($1, $2, $3, $4)
+RETURNING id`
+	for _, item := range order.Items {
+		err = tx.QueryRowContext(ctx, query, order.ID, item.GiftID, item.Quantity, item.EngravingText).Scan(&item.ID)
+		if err != nil {
+			switch {
+			case strings.Contains(err.Error(), `violates foreign key constraint "order_items_gift_id_fkey"`):
+				return ErrGiftNotFound
+			default:
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func (m OrderModel) Get(id int64) (*Order, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+SELECT id, created_at, user_id, status, recipient_name, delivery_date, gift_message, version
+FROM orders
+WHERE id = $1`
+	var order Order
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&order.ID,
+		&order.CreatedAt,
+		&order.UserID,
+		&order.Status,
+		&order.RecipientName,
+		&order.DeliveryDate,
+		&order.GiftMessage,
+		&order.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	err = m.attachItems(&order)
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// GetAll() returns a page of orders. If userID is zero, orders for every user are
+// returned (for staff with the orders:manage permission), otherwise only that user's
+// own orders are.
+func (m OrderModel) GetAll(userID int64, statuses []string, filters Filters) ([]*Order, Metadata, error) {
+	query := fmt.Sprintf(`
+SELECT count(*) OVER(), id, created_at, user_id, status, recipient_name, delivery_date, gift_message, version
+FROM orders
+WHERE (user_id = $1 OR $1 = 0)
+AND (status = ANY($2) OR cardinality($2::text[]) = 0)
+ORDER BY %s %s, id ASC
+LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	args := []interface{}{userID, pq.Array(statuses), filters.limit(), filters.offset()}
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	orders := []*Order{}
+	for rows.Next() {
+		var order Order
+		err := rows.Scan(
+			&totalRecords,
+			&order.ID,
+			&order.CreatedAt,
+			&order.UserID,
+			&order.Status,
+			&order.RecipientName,
+			&order.DeliveryDate,
+			&order.GiftMessage,
+			&order.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		orders = append(orders, &order)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	err = m.attachItems(orders...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return orders, metadata, nil
+}
+
+// The attachItems() method loads the items for the given orders with a single query.
+func (m OrderModel) attachItems(orders ...*Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+	byID := make(map[int64]*Order, len(orders))
+	ids := make([]int64, len(orders))
+	for i, order := range orders {
+		order.Items = []*OrderItem{}
+		byID[order.ID] = order
+		ids[i] = order.ID
+	}
+	query := `
+SELECT id, order_id, gift_id, quantity, engraving_text
+FROM order_items
+WHERE order_id = ANY($1)
+ORDER BY id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item OrderItem
+		var orderID int64
+		err := rows.Scan(&item.ID, &orderID, &item.GiftID, &item.Quantity, &item.EngravingText)
+		if err != nil {
+			return err
+		}
+		byID[orderID].Items = append(byID[orderID].Items, &item)
+	}
+	return rows.Err()
+}
+
+// Update() saves the personalization details and status of an order. The items of an
+// order can't be changed once it has been placed.
+func (m OrderModel) Update(order *Order) error {
+	query := `
+UPDATE orders
+SET status = $1, recipient_name = $2, delivery_date = $3, gift_message = $4, version = version + 1
+WHERE id = $5 AND version = $6
+RETURNING version`
+	args := []interface{}{
+		order.Status,
+		order.RecipientName,
+		order.DeliveryDate,
+		order.GiftMessage,
+		order.ID,
+		order.Version,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&order.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
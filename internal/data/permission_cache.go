@@ -0,0 +1,103 @@
+package data
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// permissionCacheMaxEntries bounds the size of the cache. When it is reached we first
+// drop the expired entries, and if that isn't enough, start again from empty.
+const permissionCacheMaxEntries = 10000
+
+// A PermissionCache holds users' permission codes in memory for a short time, so that
+// protected requests don't each need a query to check them. Entries are dropped when
+// the user's permissions change through the PermissionModel, and on other API servers
+// when they receive the change on the PermissionsChannel.
+type PermissionCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[int64]permissionCacheEntry
+	// generation is increased on every invalidation, so that a lookup which raced
+	// with a change doesn't put stale permissions back in the cache.
+	generation uint64
+	hits       atomic.Int64
+	misses     atomic.Int64
+}
+
+type permissionCacheEntry struct {
+	permissions Permissions
+	expiry      time.Time
+}
+
+// PermissionCacheStats are the counters exposed for monitoring.
+type PermissionCacheStats struct {
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Entries int   `json:"entries"`
+}
+
+func NewPermissionCache(ttl time.Duration) *PermissionCache {
+	return &PermissionCache{ttl: ttl, entries: make(map[int64]permissionCacheEntry)}
+}
+
+// get returns the cached permissions for a user, if there are any. It also returns
+// the current generation, to pass to set() after a miss.
+func (c *PermissionCache) get(userID int64) (Permissions, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[userID]
+	if ok && time.Now().Before(entry.expiry) {
+		c.hits.Add(1)
+		return entry.permissions, c.generation, true
+	}
+	if ok {
+		delete(c.entries, userID)
+	}
+	c.misses.Add(1)
+	return nil, c.generation, false
+}
+
+// set caches the permissions for a user, unless the cache has been invalidated since
+// the given generation.
+func (c *PermissionCache) set(userID int64, permissions Permissions, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if len(c.entries) >= permissionCacheMaxEntries {
+		now := time.Now()
+		for id, entry := range c.entries {
+			if !now.Before(entry.expiry) {
+				delete(c.entries, id)
+			}
+		}
+		if len(c.entries) >= permissionCacheMaxEntries {
+			c.entries = make(map[int64]permissionCacheEntry)
+		}
+	}
+	c.entries[userID] = permissionCacheEntry{permissions: permissions, expiry: time.Now().Add(c.ttl)}
+}
+
+// Invalidate drops the cached permissions for a user.
+func (c *PermissionCache) Invalidate(userID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	delete(c.entries, userID)
+}
+
+// InvalidateAll empties the cache, for changes which affect many users at once.
+func (c *PermissionCache) InvalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.entries = make(map[int64]permissionCacheEntry)
+}
+
+func (c *PermissionCache) Stats() PermissionCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return PermissionCacheStats{Hits: c.hits.Load(), Misses: c.misses.Load(), Entries: len(c.entries)}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"database/sql"
 	"github.com/lib/pq"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -12,33 +14,68 @@ import (
 // "movies:read" and "movies:write") for a single user.
 type Permissions []string
 
-// Add a helper method to check whether the Permissions slice contains a specific
-// permission code.
+// Add a helper method to check whether the Permissions slice grants a specific
+// permission code. As well as exact matches, a wildcard code like "gifts:*" grants
+// every code starting with "gifts:", and "*" grants every code.
 func (p Permissions) Include(code string) bool {
 	for i := range p {
-		if code == p[i] {
+		if code == p[i] || matchWildcard(p[i], code) {
 			return true
 		}
 	}
 	return false
 }
 
+func matchWildcard(pattern, code string) bool {
+	if pattern == "*" {
+		return true
+	}
+	prefix, ok := strings.CutSuffix(pattern, "*")
+	return ok && strings.HasSuffix(prefix, ":") && strings.HasPrefix(code, prefix)
+}
+
 // Define the PermissionModel type.
 type PermissionModel struct {
 	DB *sql.DB
+	// Cache is optional. When it is set, permissions are served from it where
+	// possible, and it is invalidated whenever they are changed through this model.
+	Cache *PermissionCache
 }
 
 // The GetAllForUser() method returns all permission codes for a specific user in a
-// Permissions slice. The code in this method should feel very familiar --- it uses the
-// standard pattern that we've already seen before for retrieving multiple data rows in
-// an SQL query.
+// Permissions slice, from the cache if possible.
 func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+	if m.Cache == nil {
+		return m.getAllForUser(userID)
+	}
+	permissions, generation, ok := m.Cache.get(userID)
+	if ok {
+		return permissions, nil
+	}
+	permissions, err := m.getAllForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	m.Cache.set(userID, permissions, generation)
+	return permissions, nil
+}
+
+// The getAllForUser() method reads a user's permission codes from the database: both
+// the ones granted to them directly and the ones they have through their roles. The
+// code in this method should feel very familiar --- it uses the standard pattern that
+// we've already seen before for retrieving multiple data rows in an SQL query.
+func (m PermissionModel) getAllForUser(userID int64) (Permissions, error) {
 	query := `
 SELECT permissions.code
 FROM permissions
 INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
-INNER JOIN users ON users_permissions.user_id = users.id
-WHERE users.id = $1`
+WHERE users_permissions.user_id = $1
+UNION
+SELECT permissions.code
+FROM permissions
+INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+WHERE users_roles.user_id = $1`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	rows, err := m.DB.QueryContext(ctx, query, userID)
@@ -67,9 +104,68 @@ WHERE users.id = $1`
 func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
 	query := `
 INSERT INTO users_permissions
-SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+ON CONFLICT DO NOTHING`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	if err != nil {
+		return err
+	}
+	return m.invalidate(ctx, userID)
+}
+
+// RemoveForUser() removes the provided permission codes from a user. Codes the user
+// doesn't have are ignored.
+func (m PermissionModel) RemoveForUser(userID int64, codes ...string) error {
+	query := `
+DELETE FROM users_permissions
+USING permissions
+WHERE users_permissions.permission_id = permissions.id
+AND users_permissions.user_id = $1
+AND permissions.code = ANY($2)`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
-	return err
+	if err != nil {
+		return err
+	}
+	return m.invalidate(ctx, userID)
+}
+
+// GetAll() returns every permission code that exists, in alphabetical order.
+func (m PermissionModel) GetAll() (Permissions, error) {
+	query := `
+SELECT code
+FROM permissions
+ORDER BY code`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	permissions := Permissions{}
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
+// The invalidate() helper drops a user's cached permissions after they change, and
+// tells the other API servers to drop theirs too.
+func (m PermissionModel) invalidate(ctx context.Context, userID int64) error {
+	if m.Cache != nil {
+		m.Cache.Invalidate(userID)
+	}
+	return notify(ctx, m.DB, PermissionsChannel, strconv.FormatInt(userID, 10))
 }
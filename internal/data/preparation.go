@@ -9,7 +9,7 @@ import (
 
 // Define an error that our UnmarshalJSON() method can return if we're unable to parse
 // or convert the JSON string successfully.
-var ErrInvalidPreparationFormat = errors.New("invalid runtime format")
+var ErrInvalidPreparationFormat = errors.New("invalid preparation format")
 
 type Preparation int32
 
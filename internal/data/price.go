@@ -0,0 +1,111 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"personalized_gifts.sanzhar.net/internal/validator"
+	"strconv"
+	"strings"
+)
+
+// Define an error that our UnmarshalJSON() method can return if we're unable to parse
+// or convert the JSON string successfully.
+var ErrInvalidPriceFormat = errors.New("invalid price format")
+
+// CurrencyExponents maps the ISO 4217 currency codes that we accept to the number of
+// digits after the decimal point in their minor unit (2 for USD cents, 0 for JPY).
+var CurrencyExponents = map[string]int{
+	"AUD": 2,
+	"CAD": 2,
+	"CHF": 2,
+	"CNY": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"JPY": 0,
+	"KGS": 2,
+	"KRW": 0,
+	"KWD": 3,
+	"KZT": 2,
+	"RUB": 2,
+	"TRY": 2,
+	"USD": 2,
+	"UZS": 2,
+}
+
+// Price is an amount of money stored as an integer number of minor units (cents, for
+// example) so that we never have floating point rounding errors. In JSON it is encoded
+// as a string like "12.50 USD".
+type Price struct {
+	Amount   int64
+	Currency string
+}
+
+// Implement a MarshalJSON() method on the Price type so that it satisfies the
+// json.Marshaler interface, in the same way as for Preparation.
+func (p Price) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(p.String())), nil
+}
+
+// String formats the price with the right number of decimal places for its currency.
+func (p Price) String() string {
+	exponent := CurrencyExponents[p.Currency]
+	if exponent == 0 {
+		return fmt.Sprintf("%d %s", p.Amount, p.Currency)
+	}
+	unit := int64(math.Pow10(exponent))
+	sign := ""
+	amount := p.Amount
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	return fmt.Sprintf("%s%d.%0*d %s", sign, amount/unit, exponent, amount%unit, p.Currency)
+}
+
+// Implement a UnmarshalJSON() method on the Price type. We expect a string in the
+// format "<amount> <currency>", where the amount has at most as many decimal places as
+// the currency's minor unit.
+func (p *Price) UnmarshalJSON(jsonValue []byte) error {
+	unquotedJSONValue, err := strconv.Unquote(string(jsonValue))
+	if err != nil {
+		return ErrInvalidPriceFormat
+	}
+	parts := strings.Split(unquotedJSONValue, " ")
+	if len(parts) != 2 {
+		return ErrInvalidPriceFormat
+	}
+	exponent, ok := CurrencyExponents[parts[1]]
+	if !ok {
+		return ErrInvalidPriceFormat
+	}
+	amount, err := ParseAmount(parts[0], exponent)
+	if err != nil {
+		return ErrInvalidPriceFormat
+	}
+	*p = Price{Amount: amount, Currency: parts[1]}
+	return nil
+}
+
+// ParseAmount converts a decimal string like "12.5" into minor units for a currency
+// with the given exponent (1250 for an exponent of 2). It doesn't go via a float, so
+// there are no rounding errors, and it rejects more decimal places than the currency
+// has.
+func ParseAmount(s string, exponent int) (int64, error) {
+	whole, fraction, found := strings.Cut(s, ".")
+	if whole == "" || (found && (fraction == "" || len(fraction) > exponent)) {
+		return 0, ErrInvalidPriceFormat
+	}
+	fraction += strings.Repeat("0", exponent-len(fraction))
+	amount, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil || strings.HasPrefix(whole, "-") || strings.HasPrefix(whole, "+") {
+		return 0, ErrInvalidPriceFormat
+	}
+	return amount, nil
+}
+
+func ValidatePrice(v *validator.Validator, key string, price Price) {
+	v.Check(price.Amount > 0, key, "must be greater than zero")
+	v.Check(price.Amount <= 1_000_000_000_00, key, "must not be more than 1 billion")
+	_, ok := CurrencyExponents[price.Currency]
+	v.Check(ok, key, "must use a supported ISO 4217 currency code")
+}
@@ -0,0 +1,98 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"personalized_gifts.sanzhar.net/internal/validator"
+	"time"
+)
+
+// effectivePrice is the SQL expression for the price a customer actually pays for a
+// gift: its base price scaled by the multiplier for its superiority tier, if one has
+// been configured. This lets a gold version be priced off the silver base without
+// editing every gift whenever the multipliers change.
+const effectivePrice = `(round(gifts.price_amount * COALESCE((
+	SELECT superiority_multipliers.multiplier
+	FROM superiority_multipliers
+	WHERE superiority_multipliers.superiority = gifts.superiority), 1))::bigint)`
+
+// A SuperiorityMultiplier scales the base price of every gift in a superiority tier.
+type SuperiorityMultiplier struct {
+	Superiority string    `json:"superiority"`
+	Multiplier  float64   `json:"multiplier"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func ValidateSuperiorityMultiplier(v *validator.Validator, m *SuperiorityMultiplier) {
+	v.Check(validator.In(m.Superiority, GiftSuperiorities...), "superiority", "must be one of silver, gold or diamond")
+	v.Check(m.Multiplier > 0, "multiplier", "must be greater than zero")
+	v.Check(m.Multiplier < 1000, "multiplier", "must be less than 1000")
+}
+
+// Define the PricingModel type.
+type PricingModel struct {
+	DB *sql.DB
+}
+
+// GetAllMultipliers() returns the configured multipliers. Tiers without one are
+// priced at their base price.
+func (m PricingModel) GetAllMultipliers() ([]*SuperiorityMultiplier, error) {
+	query := `
+SELECT superiority, multiplier, updated_at
+FROM superiority_multipliers
+ORDER BY multiplier, superiority`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	multipliers := []*SuperiorityMultiplier{}
+	for rows.Next() {
+		var multiplier SuperiorityMultiplier
+		err := rows.Scan(&multiplier.Superiority, &multiplier.Multiplier, &multiplier.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		multipliers = append(multipliers, &multiplier)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return multipliers, nil
+}
+
+// SetMultiplier() creates or replaces the multiplier for a superiority tier.
+func (m PricingModel) SetMultiplier(multiplier *SuperiorityMultiplier) error {
+	query := `
+INSERT INTO superiority_multipliers (superiority, multiplier)
+VALUES ($1, $2)
+ON CONFLICT (superiority) DO UPDATE SET multiplier = EXCLUDED.multiplier, updated_at = NOW()
+RETURNING multiplier, updated_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, multiplier.Superiority, multiplier.Multiplier).Scan(&multiplier.Multiplier, &multiplier.UpdatedAt)
+}
+
+// DeleteMultiplier() removes the multiplier for a superiority tier, so that its gifts
+// go back to their base price.
+func (m PricingModel) DeleteMultiplier(superiority string) error {
+	query := `
+DELETE FROM superiority_multipliers
+WHERE superiority = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, superiority)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
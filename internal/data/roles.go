@@ -0,0 +1,323 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"personalized_gifts.sanzhar.net/internal/validator"
+	"strconv"
+	"time"
+)
+
+// ErrDuplicateRoleName is returned when creating or renaming a role to a name which
+// is already taken.
+var ErrDuplicateRoleName = errors.New("duplicate role name")
+
+// A Role is a named bundle of permission codes. Users have the permissions of all of
+// their roles, as well as any that have been granted to them directly.
+type Role struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"-"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Permissions Permissions `json:"permissions"`
+	Version     int32       `json:"version"`
+}
+
+func ValidateRole(v *validator.Validator, role *Role) {
+	v.Check(role.Name != "", "name", "must be provided")
+	v.Check(len(role.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(validator.Matches(role.Name, validator.SlugRX), "name", "must only contain lowercase letters, digits and single hyphens")
+	v.Check(len(role.Description) <= 500, "description", "must not be more than 500 bytes long")
+}
+
+// Define the RoleModel type.
+type RoleModel struct {
+	DB *sql.DB
+	// Cache is the permission cache, if there is one, which needs invalidating when
+	// roles change.
+	Cache *PermissionCache
+}
+
+// Insert() creates a role along with its permissions.
+func (m RoleModel) Insert(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := `
+INSERT INTO roles (name, description)
+VALUES ($1, $2)
+RETURNING id, created_at, version`
+	err = tx.QueryRowContext(ctx, query, role.Name, role.Description).Scan(&role.ID, &role.CreatedAt, &role.Version)
+	if err != nil {
+		return roleError(err)
+	}
+	err = setRolePermissions(ctx, tx, role)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m RoleModel) Get(id int64) (*Role, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	return m.get("roles.id = $1", id)
+}
+
+func (m RoleModel) GetByName(name string) (*Role, error) {
+	return m.get("roles.name = $1", name)
+}
+
+func (m RoleModel) get(where string, arg interface{}) (*Role, error) {
+	query := `
+SELECT roles.id, roles.created_at, roles.name, roles.description, ` + rolePermissions + `, roles.version
+FROM roles
+WHERE ` + where
+	var role Role
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, arg).Scan(
+		&role.ID,
+		&role.CreatedAt,
+		&role.Name,
+		&role.Description,
+		pq.Array(&role.Permissions),
+		&role.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &role, nil
+}
+
+// rolePermissions is the SQL expression for the sorted permission codes of a role.
+const rolePermissions = `ARRAY(
+	SELECT permissions.code
+	FROM permissions
+	INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+	WHERE roles_permissions.role_id = roles.id
+	ORDER BY permissions.code)`
+
+// GetAll() returns every role, ordered by name. Like categories there are few enough
+// of them that we don't paginate.
+func (m RoleModel) GetAll() ([]*Role, error) {
+	return m.getAll(`
+SELECT roles.id, roles.created_at, roles.name, roles.description, ` + rolePermissions + `, roles.version
+FROM roles
+ORDER BY roles.name`)
+}
+
+// GetAllForUser() returns the roles that a user has, ordered by name.
+func (m RoleModel) GetAllForUser(userID int64) ([]*Role, error) {
+	return m.getAll(`
+SELECT roles.id, roles.created_at, roles.name, roles.description, `+rolePermissions+`, roles.version
+FROM roles
+INNER JOIN users_roles ON users_roles.role_id = roles.id
+WHERE users_roles.user_id = $1
+ORDER BY roles.name`, userID)
+}
+
+// GetUserIDs() returns the IDs of the users who have the role.
+func (m RoleModel) GetUserIDs(roleID int64) ([]int64, error) {
+	query := `
+SELECT user_id
+FROM users_roles
+WHERE role_id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, roleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	userIDs := []int64{}
+	for rows.Next() {
+		var userID int64
+		err := rows.Scan(&userID)
+		if err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return userIDs, nil
+}
+
+func (m RoleModel) getAll(query string, args ...interface{}) ([]*Role, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	roles := []*Role{}
+	for rows.Next() {
+		var role Role
+		err := rows.Scan(
+			&role.ID,
+			&role.CreatedAt,
+			&role.Name,
+			&role.Description,
+			pq.Array(&role.Permissions),
+			&role.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, &role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// Update() saves the role and replaces its permissions. Because this can change the
+// permissions of many users at once, the whole permission cache is invalidated.
+func (m RoleModel) Update(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := `
+UPDATE roles
+SET name = $1, description = $2, version = version + 1
+WHERE id = $3 AND version = $4
+RETURNING version`
+	args := []interface{}{role.Name, role.Description, role.ID, role.Version}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&role.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return roleError(err)
+		}
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM roles_permissions WHERE role_id = $1`, role.ID)
+	if err != nil {
+		return err
+	}
+	err = setRolePermissions(ctx, tx, role)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	return m.invalidateAll(ctx)
+}
+
+func (m RoleModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	query := `
+DELETE FROM roles
+WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return m.invalidateAll(ctx)
+}
+
+// AddForUser() gives a user the roles with the provided names. Names which don't
+// exist, or roles the user already has, are ignored.
+func (m RoleModel) AddForUser(userID int64, names ...string) error {
+	query := `
+INSERT INTO users_roles
+SELECT $1, roles.id FROM roles WHERE roles.name = ANY($2)
+ON CONFLICT DO NOTHING`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(names))
+	if err != nil {
+		return err
+	}
+	return m.invalidate(ctx, userID)
+}
+
+// RemoveForUser() takes the roles with the provided names away from a user.
+func (m RoleModel) RemoveForUser(userID int64, names ...string) error {
+	query := `
+DELETE FROM users_roles
+USING roles
+WHERE users_roles.role_id = roles.id
+AND users_roles.user_id = $1
+AND roles.name = ANY($2)`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(names))
+	if err != nil {
+		return err
+	}
+	return m.invalidate(ctx, userID)
+}
+
+// The invalidate() and invalidateAll() helpers drop cached permissions after a change
+// to roles, for one user or for everyone, and tell the other API servers to do the
+// same.
+func (m RoleModel) invalidate(ctx context.Context, userID int64) error {
+	if m.Cache != nil {
+		m.Cache.Invalidate(userID)
+	}
+	return notify(ctx, m.DB, PermissionsChannel, strconv.FormatInt(userID, 10))
+}
+
+func (m RoleModel) invalidateAll(ctx context.Context) error {
+	if m.Cache != nil {
+		m.Cache.InvalidateAll()
+	}
+	return notify(ctx, m.DB, PermissionsChannel, "")
+}
+
+// The setRolePermissions() helper inserts the permissions of a role, as part of a
+// transaction.
+func setRolePermissions(ctx context.Context, tx *sql.Tx, role *Role) error {
+	query := `
+INSERT INTO roles_permissions
+SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+ON CONFLICT DO NOTHING`
+	_, err := tx.ExecContext(ctx, query, role.ID, pq.Array(role.Permissions))
+	return err
+}
+
+// The roleError() helper converts the constraint violations that clients can trigger
+// into our own error values.
+func roleError(err error) error {
+	switch {
+	case err.Error() == `pq: duplicate key value violates unique constraint "roles_name_key"`:
+		return ErrDuplicateRoleName
+	default:
+		return err
+	}
+}
@@ -6,8 +6,12 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
+	"github.com/lib/pq"
 	"personalized_gifts.sanzhar.net/internal/validator"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // Define constants for the token scope. For now we just define the scope "activation"
@@ -15,8 +19,17 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication" // Include a new authentication scope.
+	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
+	ScopeEmailChange    = "email-change"
+	ScopeMFAChallenge   = "mfa-challenge"
 )
 
+// ErrTokenReused is returned when a refresh token which has already been exchanged is
+// presented again. This means it has probably been stolen, so the whole token family
+// is revoked.
+var ErrTokenReused = errors.New("refresh token reused")
+
 // Add struct tags to control how the struct appears when encoded to JSON.
 type Token struct {
 	Plaintext string    `json:"token"`
@@ -24,6 +37,27 @@ type Token struct {
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	UserAgent string    `json:"-"`
+	IP        string    `json:"-"`
+	// Family links the access and refresh tokens that descend from the same login,
+	// so that they can be revoked together. It defaults to the token's own hash.
+	Family []byte `json:"-"`
+	// MFA is whether the login that the token descends from used two-factor
+	// authentication.
+	MFA bool `json:"-"`
+}
+
+// A Session describes a login which is still valid (a family of access and refresh
+// tokens), so that users can see where they are logged in. It never includes the
+// tokens themselves.
+type Session struct {
+	Family    []byte     `json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	Expiry    time.Time  `json:"expiry"`
+	LastUsed  *time.Time `json:"last_used"`
+	UserAgent string     `json:"user_agent"`
+	IP        string     `json:"ip"`
+	Current   bool       `json:"current"`
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -85,12 +119,141 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
-// Insert() adds the data for a specific token to the tokens table.
+// NewPair() creates a short-lived access token (with the authentication scope) and a
+// longer-lived refresh token for a new login. Both belong to a new token family, and
+// record the user agent and IP address of the client for the session list, and
+// whether the login used two-factor authentication.
+func (m TokenModel) NewPair(userID int64, mfa bool, accessTTL, refreshTTL time.Duration, userAgent, ip string) (*Token, *Token, error) {
+	family := make([]byte, 16)
+	_, err := rand.Read(family)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+	access, refresh, err := insertPair(ctx, tx, userID, family, mfa, accessTTL, refreshTTL, userAgent, ip)
+	if err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, tx.Commit()
+}
+
+// Rotate() exchanges a refresh token for a new access and refresh token pair in the
+// same family. Each refresh token can only be used once: if a used one is presented
+// again, every token in its family is deleted and ErrTokenReused is returned.
+func (m TokenModel) Rotate(refreshPlaintext string, accessTTL, refreshTTL time.Duration, userAgent, ip string) (*Token, *Token, error) {
+	refreshHash := sha256.Sum256([]byte(refreshPlaintext))
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+	// Lock the row, so that two concurrent requests with the same refresh token can't
+	// both succeed.
+	query := `
+SELECT user_id, family, mfa, used_at
+FROM tokens
+WHERE hash = $1 AND scope = $2 AND expiry > $3
+FOR UPDATE`
+	var (
+		userID int64
+		family []byte
+		mfa    bool
+		usedAt *time.Time
+	)
+	err = tx.QueryRowContext(ctx, query, refreshHash[:], ScopeRefresh, time.Now()).Scan(&userID, &family, &mfa, &usedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+	if usedAt != nil {
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family = $1`, family)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrTokenReused
+	}
+	// Keep the used refresh token until it expires, rather than deleting it, so that
+	// we can recognise it if it's presented again.
+	_, err = tx.ExecContext(ctx, `UPDATE tokens SET used_at = NOW(), last_used = NOW() WHERE hash = $1`, refreshHash[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	access, refresh, err := insertPair(ctx, tx, userID, family, mfa, accessTTL, refreshTTL, userAgent, ip)
+	if err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, tx.Commit()
+}
+
+// Truncate returns s cut down to at most n bytes, without splitting a UTF-8 character.
+// Any invalid UTF-8 is replaced as well, as PostgreSQL rejects it in text columns.
+func Truncate(s string, n int) string {
+	s = strings.ToValidUTF8(s, "\uFFFD")
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// The insertPair() helper generates and inserts an access and refresh token in the
+// given family, as part of a transaction.
+func insertPair(ctx context.Context, tx *sql.Tx, userID int64, family []byte, mfa bool, accessTTL, refreshTTL time.Duration, userAgent, ip string) (*Token, *Token, error) {
+	// Cap the user agent, as it's supplied by the client.
+	userAgent = Truncate(userAgent, 512)
+	access, err := generateToken(userID, accessTTL, ScopeAuthentication)
+	if err != nil {
+		return nil, nil, err
+	}
+	refresh, err := generateToken(userID, refreshTTL, ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+	query := `
+INSERT INTO tokens (hash, user_id, expiry, scope, user_agent, ip, family, mfa)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	for _, token := range []*Token{access, refresh} {
+		token.UserAgent = userAgent
+		token.IP = ip
+		token.Family = family
+		token.MFA = mfa
+		args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.UserAgent, token.IP, token.Family, token.MFA}
+		_, err = tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return access, refresh, nil
+}
+
+// Insert() adds the data for a specific token to the tokens table. A token which isn't
+// part of a login is in a family of its own.
 func (m TokenModel) Insert(token *Token) error {
+	if token.Family == nil {
+		token.Family = token.Hash
+	}
 	query := `
-INSERT INTO tokens (hash, user_id, expiry, scope)
-VALUES ($1, $2, $3, $4)`
-	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
+INSERT INTO tokens (hash, user_id, expiry, scope, user_agent, ip, family)
+VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.UserAgent, token.IP, token.Family}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	_, err := m.DB.ExecContext(ctx, query, args...)
@@ -107,3 +270,156 @@ WHERE scope = $1 AND user_id = $2`
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+// LatestExpiryForUser() returns the latest expiry time of the user's tokens with the
+// given scope, or the zero time if they have none. Because every token in a scope is
+// created with the same TTL, this tells us when the most recent one was issued.
+func (m TokenModel) LatestExpiryForUser(scope string, userID int64) (time.Time, error) {
+	query := `
+SELECT COALESCE(MAX(expiry), 'epoch')
+FROM tokens
+WHERE scope = $1 AND user_id = $2`
+	var expiry time.Time
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, scope, userID).Scan(&expiry)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if expiry.Unix() == 0 {
+		return time.Time{}, nil
+	}
+	return expiry, nil
+}
+
+// Delete() deletes a token, given its plaintext, as long as it belongs to the user
+// and has the given scope. The other tokens in its family are deleted too, so that
+// logging out also revokes the refresh token for the session.
+func (m TokenModel) Delete(scope string, userID int64, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+DELETE FROM tokens
+WHERE user_id = $3 AND family = (
+	SELECT family FROM tokens WHERE hash = $1 AND scope = $2 AND user_id = $3
+)`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, tokenHash[:], scope, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// DeleteFamily() deletes all of the user's tokens in a token family.
+func (m TokenModel) DeleteFamily(userID int64, family []byte) error {
+	query := `
+DELETE FROM tokens
+WHERE user_id = $1 AND family = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, userID, family)
+	return err
+}
+
+// GetFamily() returns the family of a token, given its plaintext.
+func (m TokenModel) GetFamily(tokenPlaintext string) ([]byte, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+SELECT family
+FROM tokens
+WHERE hash = $1`
+	var family []byte
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:]).Scan(&family)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return family, nil
+}
+
+// DeleteOtherSessions() deletes the user's authentication and refresh tokens, except
+// for the ones in the given family, logging them out everywhere else.
+func (m TokenModel) DeleteOtherSessions(userID int64, family []byte) error {
+	query := `
+DELETE FROM tokens
+WHERE user_id = $1 AND scope = ANY($2) AND family IS DISTINCT FROM $3`
+	scopes := []string{ScopeAuthentication, ScopeRefresh}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(scopes), family)
+	return err
+}
+
+// Touch() records that a token has just been used. To avoid a write on every request
+// we only update last_used when it is more than a minute old.
+func (m TokenModel) Touch(tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+UPDATE tokens
+SET last_used = NOW()
+WHERE hash = $1 AND (last_used IS NULL OR last_used < NOW() - INTERVAL '1 minute')`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:])
+	return err
+}
+
+// GetSessionsForUser() returns the user's active sessions, most recently created
+// first. A session is a token family with an unexpired access token or unused refresh
+// token; its user agent and IP address are the ones it was most recently issued to.
+// The session that currentPlaintext belongs to (if any) is marked as the current one.
+func (m TokenModel) GetSessionsForUser(userID int64, currentPlaintext string) ([]*Session, error) {
+	currentHash := sha256.Sum256([]byte(currentPlaintext))
+	query := `
+SELECT family, MIN(created_at), MAX(expiry), MAX(last_used),
+	(array_agg(user_agent ORDER BY created_at DESC))[1],
+	(array_agg(ip ORDER BY created_at DESC))[1],
+	family = COALESCE((SELECT family FROM tokens WHERE hash = $4), '')
+FROM tokens
+WHERE user_id = $1 AND scope = ANY($2) AND expiry > $3 AND used_at IS NULL
+GROUP BY family
+ORDER BY MIN(created_at) DESC`
+	scopes := []string{ScopeAuthentication, ScopeRefresh}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID, pq.Array(scopes), time.Now(), currentHash[:])
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(
+			&session.Family,
+			&session.CreatedAt,
+			&session.Expiry,
+			&session.LastUsed,
+			&session.UserAgent,
+			&session.IP,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
 	"golang.org/x/crypto/bcrypt"
 	"personalized_gifts.sanzhar.net/internal/validator"
 	"time"
@@ -25,7 +26,9 @@ type User struct {
 	Email     string    `json:"email"`
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	// Disabled users have been deactivated by an administrator, and can't log in.
+	Disabled bool `json:"disabled"`
+	Version  int  `json:"version"`
 }
 
 // Check if a User instance is the AnonymousUser.
@@ -70,6 +73,17 @@ func (p *password) Matches(plaintextPassword string) (bool, error) {
 	return true, nil
 }
 
+// dummyPasswordHash is a bcrypt hash with the same cost as the ones we store for users.
+var dummyPasswordHash = []byte("$2a$12$slscgJ0bLAKCgfbO2My2IOXwdxQCRAY2bblBy.fZAfzCxANIXSAQK")
+
+// The CompareDummyPassword() function does the same work as checking a user's
+// password, for when there is no user with the email address that the client gave us.
+// That way a login for an unknown email takes as long as one with a wrong password,
+// and the response time doesn't give away which emails are registered.
+func CompareDummyPassword(plaintextPassword string) {
+	_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(plaintextPassword))
+}
+
 func ValidateEmail(v *validator.Validator, email string) {
 	v.Check(email != "", "email", "must be provided")
 	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
@@ -132,12 +146,45 @@ RETURNING id, created_at, version`
 	return nil
 }
 
+// Retrieve the User details from the database based on the user's ID.
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+SELECT id, created_at, name, email, password_hash, activated, disabled, version
+FROM users
+WHERE id = $1`
+	var user User
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Disabled,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
 // Retrieve the User details from the database based on the user's email address.
 // Because we have a UNIQUE constraint on the email column, this SQL query will only
 // return one record (or none at all, in which case we return a ErrRecordNotFound error).
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
-SELECT id, created_at, name, email, password_hash, activated, version
+SELECT id, created_at, name, email, password_hash, activated, disabled, version
 FROM users
 WHERE email = $1`
 	var user User
@@ -150,6 +197,7 @@ WHERE email = $1`
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Disabled,
 		&user.Version,
 	)
 	if err != nil {
@@ -171,14 +219,15 @@ WHERE email = $1`
 func (m UserModel) Update(user *User) error {
 	query := `
 UPDATE users
-SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-WHERE id = $5 AND version = $6
+SET name = $1, email = $2, password_hash = $3, activated = $4, disabled = $5, version = version + 1
+WHERE id = $6 AND version = $7
 RETURNING version`
 	args := []interface{}{
 		user.Name,
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.Disabled,
 		user.ID,
 		user.Version,
 	}
@@ -204,13 +253,14 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 	// Set up the SQL query.
 	query := `
-SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.disabled, users.version
 FROM users
 INNER JOIN tokens
 ON users.id = tokens.user_id
 WHERE tokens.hash = $1
 AND tokens.scope = $2
-AND tokens.expiry > $3`
+AND tokens.expiry > $3
+AND NOT users.disabled`
 	// Create a slice containing the query arguments. Notice how we use the [:] operator
 	// to get a slice containing the token hash, rather than passing in the array (which
 	// is not supported by the pq driver), and that we pass the current time as the
@@ -228,6 +278,7 @@ AND tokens.expiry > $3`
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Disabled,
 		&user.Version,
 	)
 	if err != nil {
@@ -241,3 +292,110 @@ AND tokens.expiry > $3`
 	// Return the matching user.
 	return &user, nil
 }
+
+// GetAll() returns a page of users. If search isn't empty, only users whose name or
+// email address contains it (ignoring case) are included.
+func (m UserModel) GetAll(search string, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+SELECT count(*) OVER(), id, created_at, name, email, password_hash, activated, disabled, version
+FROM users
+WHERE ($1 = '' OR name ILIKE '%%' || $1 || '%%' OR email ILIKE '%%' || $1 || '%%')
+ORDER BY %s %s, id ASC
+LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	args := []interface{}{search, filters.limit(), filters.offset()}
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	users := []*User{}
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Disabled,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		users = append(users, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return users, metadata, nil
+}
+
+// SetPendingEmail() records the email address that a user has asked to change to.
+// It only replaces their real email address once they confirm it, with
+// ConfirmPendingEmail().
+func (m UserModel) SetPendingEmail(userID int64, email string) error {
+	query := `
+UPDATE users
+SET pending_email = $1
+WHERE id = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, email, userID)
+	return err
+}
+
+// ConfirmPendingEmail() makes the user's pending email address their real one, and
+// updates the user struct to match.
+func (m UserModel) ConfirmPendingEmail(user *User) error {
+	query := `
+UPDATE users
+SET email = pending_email, pending_email = NULL, version = version + 1
+WHERE id = $1 AND pending_email IS NOT NULL
+RETURNING email, version`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, user.ID).Scan(&user.Email, &user.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+			return ErrDuplicateEmail
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete() deletes a user. Their tokens, permissions and orders are deleted with
+// them by the foreign keys, and the gifts they created are kept without an owner.
+func (m UserModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	query := `
+DELETE FROM users
+WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
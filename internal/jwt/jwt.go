@@ -0,0 +1,243 @@
+// Package jwt issues and verifies the signed JSON Web Tokens used by the stateless
+// authentication mode. It supports HS256 (HMAC-SHA256) and EdDSA (Ed25519) keys, each
+// with a key ID so that keys can be rotated: tokens are signed with one key and
+// verified with whichever key their "kid" header names.
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Supported signing algorithms.
+const (
+	HS256 = "HS256"
+	EdDSA = "EdDSA"
+)
+
+var (
+	// ErrInvalidToken is returned for any token which is malformed, has a bad
+	// signature or is signed with an unknown key.
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrExpiredToken is returned for a correctly signed token which has expired.
+	ErrExpiredToken = errors.New("expired token")
+)
+
+var encoding = base64.RawURLEncoding
+
+// Claims are the contents of a token. Alongside the registered claims we carry
+// enough about the user that requests can be authenticated without a database lookup.
+type Claims struct {
+	Issuer  string `json:"iss"`
+	Subject string `json:"sub"`
+	ID      string `json:"jti"`
+	// IssuedAt has sub-second precision (which RFC 7519 allows), so that a token
+	// issued just after its user's tokens were revoked can be told apart from one
+	// issued just before.
+	IssuedAt    float64  `json:"iat"`
+	ExpiresAt   int64    `json:"exp"`
+	SessionID   string   `json:"sid,omitempty"`
+	Name        string   `json:"name"`
+	Email       string   `json:"email"`
+	Activated   bool     `json:"act"`
+	Permissions []string `json:"perms"`
+}
+
+// UserID returns the subject claim as a user ID.
+func (c *Claims) UserID() (int64, error) {
+	id, err := strconv.ParseInt(c.Subject, 10, 64)
+	if err != nil || id < 1 {
+		return 0, ErrInvalidToken
+	}
+	return id, nil
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// A Key is a named signing or verification key. Ed25519 keys loaded from a public key
+// file can only verify tokens.
+type Key struct {
+	ID        string
+	Algorithm string
+	secret    []byte
+	private   ed25519.PrivateKey
+	public    ed25519.PublicKey
+}
+
+// LoadKey reads a key from a file. HS256 keys are the raw contents of the file, which
+// must be at least 32 bytes. EdDSA keys are PEM encoded, either as a PKCS #8 private
+// key or as a PKIX public key.
+func LoadKey(id, algorithm, path string) (*Key, error) {
+	if id == "" {
+		return nil, errors.New("jwt: key ID must not be empty")
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := &Key{ID: id, Algorithm: algorithm}
+	switch algorithm {
+	case HS256:
+		if len(contents) < 32 {
+			return nil, fmt.Errorf("jwt: HMAC key %q must be at least 32 bytes long", id)
+		}
+		key.secret = contents
+	case EdDSA:
+		block, _ := pem.Decode(contents)
+		if block == nil {
+			return nil, fmt.Errorf("jwt: key %q is not PEM encoded", id)
+		}
+		switch block.Type {
+		case "PRIVATE KEY":
+			parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			private, ok := parsed.(ed25519.PrivateKey)
+			if !ok {
+				return nil, fmt.Errorf("jwt: key %q is not an Ed25519 key", id)
+			}
+			key.private = private
+			key.public = private.Public().(ed25519.PublicKey)
+		case "PUBLIC KEY":
+			parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			public, ok := parsed.(ed25519.PublicKey)
+			if !ok {
+				return nil, fmt.Errorf("jwt: key %q is not an Ed25519 key", id)
+			}
+			key.public = public
+		default:
+			return nil, fmt.Errorf("jwt: unsupported PEM block %q in key %q", block.Type, id)
+		}
+	default:
+		return nil, fmt.Errorf("jwt: unsupported algorithm %q", algorithm)
+	}
+	return key, nil
+}
+
+func (k *Key) canSign() bool {
+	return k.secret != nil || k.private != nil
+}
+
+func (k *Key) sign(input []byte) []byte {
+	if k.Algorithm == HS256 {
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(input)
+		return mac.Sum(nil)
+	}
+	return ed25519.Sign(k.private, input)
+}
+
+func (k *Key) verify(input, signature []byte) bool {
+	if k.Algorithm == HS256 {
+		return hmac.Equal(k.sign(input), signature)
+	}
+	return ed25519.Verify(k.public, input, signature)
+}
+
+// A KeySet signs tokens with its signing key, and verifies tokens signed by any of its
+// keys.
+type KeySet struct {
+	Issuer  string
+	signing *Key
+	keys    map[string]*Key
+}
+
+// NewKeySet creates a KeySet which signs with the key called signingID.
+func NewKeySet(issuer, signingID string, keys ...*Key) (*KeySet, error) {
+	ks := &KeySet{Issuer: issuer, keys: make(map[string]*Key)}
+	for _, key := range keys {
+		if _, exists := ks.keys[key.ID]; exists {
+			return nil, fmt.Errorf("jwt: duplicate key ID %q", key.ID)
+		}
+		ks.keys[key.ID] = key
+	}
+	ks.signing = ks.keys[signingID]
+	if ks.signing == nil {
+		return nil, fmt.Errorf("jwt: unknown signing key %q", signingID)
+	}
+	if !ks.signing.canSign() {
+		return nil, fmt.Errorf("jwt: signing key %q is a public key", signingID)
+	}
+	return ks, nil
+}
+
+// Sign sets the issuer on the claims and returns them as a signed token.
+func (ks *KeySet) Sign(claims Claims) (string, error) {
+	claims.Issuer = ks.Issuer
+	h, err := json.Marshal(header{Algorithm: ks.signing.Algorithm, Type: "JWT", KeyID: ks.signing.ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := encoding.EncodeToString(h) + "." + encoding.EncodeToString(payload)
+	return input + "." + encoding.EncodeToString(ks.signing.sign([]byte(input))), nil
+}
+
+// Verify checks the token's signature, issuer and expiry at the given time, and
+// returns its claims.
+func (ks *KeySet) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	headerJSON, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var h header
+	if err := json.Unmarshal(headerJSON, &h); err != nil {
+		return nil, ErrInvalidToken
+	}
+	// Look the key up by its ID and insist that the token uses that key's algorithm,
+	// so that a token can never choose how it is verified (or claim "none").
+	key, ok := ks.keys[h.KeyID]
+	if !ok || h.Algorithm != key.Algorithm {
+		return nil, ErrInvalidToken
+	}
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil || !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidToken
+	}
+	payload, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if claims.Issuer != ks.Issuer {
+		return nil, ErrInvalidToken
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+	return &claims, nil
+}
+
+// IsToken reports whether s looks like a JWT rather than one of our opaque tokens.
+func IsToken(s string) bool {
+	return strings.Count(s, ".") == 2
+}
@@ -0,0 +1,106 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestKeySet returns a KeySet with an HS256 key "hs" (the signing key) and an EdDSA
+// key "ed", both generated for the test.
+func newTestKeySet(t *testing.T) (*KeySet, *Key, *Key) {
+	t.Helper()
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := &Key{ID: "hs", Algorithm: HS256, secret: secret}
+	ed := &Key{ID: "ed", Algorithm: EdDSA, private: private, public: public}
+	ks, err := NewKeySet("test-issuer", "hs", hs, ed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks, hs, ed
+}
+
+// makeToken builds a token with any header, signing it with the sign function.
+func makeToken(t *testing.T, h header, claims Claims, sign func([]byte) []byte) string {
+	t.Helper()
+	hJSON, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := encoding.EncodeToString(hJSON) + "." + encoding.EncodeToString(payload)
+	return input + "." + encoding.EncodeToString(sign([]byte(input)))
+}
+
+func TestVerify(t *testing.T) {
+	ks, hs, ed := newTestKeySet(t)
+	now := time.Unix(1700000000, 0)
+	claims := Claims{
+		Issuer:    "test-issuer",
+		Subject:   "42",
+		ID:        "abc",
+		IssuedAt:  float64(now.Unix()),
+		ExpiresAt: now.Add(time.Minute).Unix(),
+	}
+	expired := claims
+	expired.ExpiresAt = now.Unix()
+	otherIssuer := claims
+	otherIssuer.Issuer = "someone-else"
+	// An HMAC over the Ed25519 public key, which an attacker could compute if the
+	// token's alg header were trusted.
+	hmacWithPublicKey := func(input []byte) []byte {
+		mac := hmac.New(sha256.New, ed.public)
+		mac.Write(input)
+		return mac.Sum(nil)
+	}
+	signed, err := ks.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"HS256", signed, nil},
+		{"EdDSA", makeToken(t, header{Algorithm: EdDSA, Type: "JWT", KeyID: "ed"}, claims, ed.sign), nil},
+		{"expired", makeToken(t, header{Algorithm: HS256, Type: "JWT", KeyID: "hs"}, expired, hs.sign), ErrExpiredToken},
+		{"wrong issuer", makeToken(t, header{Algorithm: HS256, Type: "JWT", KeyID: "hs"}, otherIssuer, hs.sign), ErrInvalidToken},
+		{"unknown kid", makeToken(t, header{Algorithm: HS256, Type: "JWT", KeyID: "other"}, claims, hs.sign), ErrInvalidToken},
+		{"missing kid", makeToken(t, header{Algorithm: HS256, Type: "JWT"}, claims, hs.sign), ErrInvalidToken},
+		{"kid of another key", makeToken(t, header{Algorithm: HS256, Type: "JWT", KeyID: "ed"}, claims, hs.sign), ErrInvalidToken},
+		{"HS256 with an EdDSA key", makeToken(t, header{Algorithm: HS256, Type: "JWT", KeyID: "ed"}, claims, hmacWithPublicKey), ErrInvalidToken},
+		{"EdDSA with an HS256 key", makeToken(t, header{Algorithm: EdDSA, Type: "JWT", KeyID: "hs"}, claims, ed.sign), ErrInvalidToken},
+		{"alg none", makeToken(t, header{Algorithm: "none", Type: "JWT", KeyID: "hs"}, claims, func([]byte) []byte { return nil }), ErrInvalidToken},
+		{"bad signature", signed[:strings.LastIndex(signed, ".")+1] + encoding.EncodeToString(make([]byte, 32)), ErrInvalidToken},
+		{"malformed", "not-a-token", ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ks.Verify(tt.token, now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v; want %v", err, tt.wantErr)
+			}
+			if err == nil && (got.Subject != claims.Subject || got.ID != claims.ID) {
+				t.Errorf("Verify() claims = %+v; want %+v", got, claims)
+			}
+		})
+	}
+}
@@ -0,0 +1,457 @@
+// Package oidc implements the relying party side of OpenID Connect: the authorization
+// code flow with PKCE, and verification of the ID tokens that it returns. A Provider
+// is configured with its issuer URL, and fetches the issuer's discovery document and
+// signing keys (JWKS) when it needs them, caching both.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInvalidIDToken is returned when the provider's ID token is malformed, has a
+	// bad signature, or has claims which don't match the request.
+	ErrInvalidIDToken = errors.New("oidc: invalid ID token")
+	// ErrExchangeFailed is returned when the provider refuses to exchange the
+	// authorization code.
+	ErrExchangeFailed = errors.New("oidc: code exchange failed")
+)
+
+const (
+	// leeway allows for clock differences between us and the provider when checking
+	// the times in ID tokens.
+	leeway = time.Minute
+	// minKeyRefresh stops tokens with unknown key IDs from making us fetch the JWKS
+	// over and over.
+	minKeyRefresh = time.Minute
+)
+
+var encoding = base64.RawURLEncoding
+
+// Config describes a provider and our registration with it.
+type Config struct {
+	// Name identifies the provider in our URLs, like "google".
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is where the provider sends the user back to after they sign in.
+	// It must be registered with the provider.
+	RedirectURL string
+	Scopes      []string
+}
+
+// Claims are the claims from an ID token that we use.
+type Claims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	ExpiresAt     int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+}
+
+// audience is the "aud" claim, which can be a single string or an array of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(b, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+// UnmarshalJSON decodes the claims, accepting "email_verified" as the string "true"
+// as well as a boolean, since some providers send it that way.
+func (c *Claims) UnmarshalJSON(b []byte) error {
+	type plain Claims
+	var claims struct {
+		plain
+		EmailVerified interface{} `json:"email_verified"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return err
+	}
+	*c = Claims(claims.plain)
+	switch verified := claims.EmailVerified.(type) {
+	case bool:
+		c.EmailVerified = verified
+	case string:
+		c.EmailVerified = verified == "true"
+	}
+	return nil
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// A Provider is an OpenID Connect provider that users can sign in with. It is safe for
+// concurrent use.
+type Provider struct {
+	Config
+	client   *http.Client
+	cacheTTL time.Duration
+
+	mu               sync.Mutex
+	discovery        *discovery
+	discoveryFetched time.Time
+	keys             map[string]crypto.PublicKey
+	keysFetched      time.Time
+}
+
+// NewProvider returns a Provider which caches the discovery document and signing keys
+// for cacheTTL.
+func NewProvider(cfg Config, cacheTTL time.Duration) *Provider {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	return &Provider{
+		Config:   cfg,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		cacheTTL: cacheTTL,
+	}
+}
+
+// AuthCodeURL returns the URL to send the user to so that they can sign in. The state
+// and nonce must be checked when they come back, and the PKCE verifier used to
+// exchange the code.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	doc, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(doc.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientID)
+	query.Set("redirect_uri", p.RedirectURL)
+	query.Set("scope", strings.Join(p.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", CodeChallenge(verifier))
+	query.Set("code_challenge_method", "S256")
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Exchange swaps an authorization code for the user's ID token, and returns its claims
+// once they have been verified against the nonce from the authorization request.
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Claims, error) {
+	doc, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("client_id", p.ClientID)
+	form.Set("code_verifier", verifier)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, doc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrExchangeFailed, err)
+	}
+	if res.StatusCode != http.StatusOK || body.IDToken == "" {
+		return nil, fmt.Errorf("%w: %s %s %s", ErrExchangeFailed, res.Status, body.Error, body.ErrorDescription)
+	}
+	return p.Verify(ctx, body.IDToken, nonce, time.Now())
+}
+
+// Verify checks an ID token's signature and claims at the given time, and returns the
+// claims.
+func (p *Provider) Verify(ctx context.Context, idToken, nonce string, now time.Time) (*Claims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidIDToken
+	}
+	headerJSON, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, ErrInvalidIDToken
+	}
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+	key, err := p.getKey(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if !verifySignature(header.Algorithm, key, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidIDToken
+	}
+	payload, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidIDToken
+	}
+	switch {
+	case claims.Issuer != p.Issuer:
+		return nil, fmt.Errorf("%w: wrong issuer", ErrInvalidIDToken)
+	case !claims.Audience.contains(p.ClientID):
+		return nil, fmt.Errorf("%w: wrong audience", ErrInvalidIDToken)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidIDToken)
+	case now.Add(-leeway).Unix() >= claims.ExpiresAt:
+		return nil, fmt.Errorf("%w: expired", ErrInvalidIDToken)
+	case claims.IssuedAt > now.Add(leeway).Unix():
+		return nil, fmt.Errorf("%w: issued in the future", ErrInvalidIDToken)
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return nil, fmt.Errorf("%w: wrong nonce", ErrInvalidIDToken)
+	}
+	return &claims, nil
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// verifySignature() checks a signature made with RS256 or ES256, which between them
+// cover the providers we support. The algorithm has to match the type of key, so a
+// token can't pick a weaker way to be verified.
+func verifySignature(algorithm string, key crypto.PublicKey, input, signature []byte) bool {
+	digest := sha256.Sum256(input)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return algorithm == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		if algorithm != "ES256" || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(key, digest[:], r, s)
+	default:
+		return false
+	}
+}
+
+// getDiscovery() returns the provider's discovery document, fetching it if it isn't
+// cached or the cached copy is too old.
+func (p *Provider) getDiscovery(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil && time.Since(p.discoveryFetched) < p.cacheTTL {
+		return p.discovery, nil
+	}
+	var doc discovery
+	err := p.getJSON(ctx, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &doc)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Issuer != p.Issuer {
+		return nil, fmt.Errorf("oidc: discovery document is for issuer %q, not %q", doc.Issuer, p.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, errors.New("oidc: discovery document is missing endpoints")
+	}
+	p.discovery = &doc
+	p.discoveryFetched = time.Now()
+	return p.discovery, nil
+}
+
+// getKey() returns the signing key with the given ID. The key set is fetched again if
+// the cached copy is too old, or doesn't have the key because the provider has rotated
+// its keys since we fetched it.
+func (p *Provider) getKey(ctx context.Context, keyID string) (crypto.PublicKey, error) {
+	doc, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, ok := p.lookupKey(keyID)
+	stale := time.Since(p.keysFetched) >= p.cacheTTL
+	if ok && !stale {
+		return key, nil
+	}
+	if !stale && time.Since(p.keysFetched) < minKeyRefresh {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidIDToken, keyID)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err = p.getJSON(ctx, doc.JWKSURI, &set)
+	if err != nil {
+		return nil, err
+	}
+	p.keys = make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		// Skip keys of types that we don't support, rather than failing.
+		if public, err := k.publicKey(); err == nil {
+			p.keys[k.KeyID] = public
+		}
+	}
+	p.keysFetched = time.Now()
+	key, ok = p.lookupKey(keyID)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidIDToken, keyID)
+	}
+	return key, nil
+}
+
+// lookupKey() finds a cached key. Tokens without a key ID are allowed if the provider
+// only has one key. The caller must hold the mutex.
+func (p *Provider) lookupKey(keyID string) (crypto.PublicKey, bool) {
+	if keyID == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[keyID]
+	return key, ok
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, dst interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: GET %s: %s", url, res.Status)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(dst)
+}
+
+// jwk is a JSON Web Key, as found in a provider's key set.
+type jwk struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := encoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := encoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 || exponent.Int64() < 3 {
+			return nil, errors.New("oidc: bad RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		if k.Curve != "P-256" {
+			return nil, fmt.Errorf("oidc: unsupported curve %q", k.Curve)
+		}
+		x, err := encoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := encoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("oidc: EC point is not on the curve")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("oidc: unsupported key type %q", k.KeyType)
+	}
+}
+
+// RandomString returns a random URL-safe string, for states and nonces.
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// CodeChallenge returns the S256 PKCE challenge for a verifier.
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return encoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,183 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testProvider is an identity provider serving a discovery document and a key set
+// with an RSA key "rsa", a P-256 key "ec", and a key "off-curve" whose point isn't on
+// the curve.
+type testProvider struct {
+	server *httptest.Server
+	rsa    *rsa.PrivateKey
+	ec     *ecdsa.PrivateKey
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp := &testProvider{rsa: rsaKey, ec: ecKey}
+	offCurveY := new(big.Int).Add(ecKey.Y, big.NewInt(1))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(discovery{
+			Issuer:                tp.server.URL,
+			AuthorizationEndpoint: tp.server.URL + "/authorize",
+			TokenEndpoint:         tp.server.URL + "/token",
+			JWKSURI:               tp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": {
+			{KeyType: "RSA", KeyID: "rsa", Use: "sig", N: encoding.EncodeToString(rsaKey.N.Bytes()), E: encoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{KeyType: "EC", KeyID: "ec", Use: "sig", Curve: "P-256", X: encoding.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))), Y: encoding.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32)))},
+			{KeyType: "EC", KeyID: "off-curve", Use: "sig", Curve: "P-256", X: encoding.EncodeToString(ecKey.X.Bytes()), Y: encoding.EncodeToString(offCurveY.Bytes())},
+		}})
+	})
+	tp.server = httptest.NewServer(mux)
+	t.Cleanup(tp.server.Close)
+	return tp
+}
+
+func (tp *testProvider) signRS256(t *testing.T, input []byte) []byte {
+	t.Helper()
+	digest := sha256.Sum256(input)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, tp.rsa, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+func (tp *testProvider) signES256(t *testing.T, input []byte) []byte {
+	t.Helper()
+	digest := sha256.Sum256(input)
+	r, s, err := ecdsa.Sign(rand.Reader, tp.ec, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signature
+}
+
+// makeIDToken builds an ID token with the given header and claims, signing it with
+// the sign function.
+func makeIDToken(t *testing.T, alg, kid string, claims map[string]interface{}, sign func(*testing.T, []byte) []byte) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := encoding.EncodeToString(header) + "." + encoding.EncodeToString(payload)
+	return input + "." + encoding.EncodeToString(sign(t, []byte(input)))
+}
+
+func TestVerify(t *testing.T) {
+	tp := newTestProvider(t)
+	provider := NewProvider(Config{Name: "test", Issuer: tp.server.URL, ClientID: "client"}, time.Hour)
+	now := time.Unix(1700000000, 0)
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":   tp.server.URL,
+			"sub":   "user-1",
+			"aud":   "client",
+			"exp":   now.Add(time.Hour).Unix(),
+			"iat":   now.Unix(),
+			"nonce": "nonce",
+			"email": "alice@example.com",
+		}
+		for k, v := range changes {
+			c[k] = v
+		}
+		return c
+	}
+	none := func(*testing.T, []byte) []byte { return nil }
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"RS256", makeIDToken(t, "RS256", "rsa", claims(nil), tp.signRS256), false},
+		{"ES256", makeIDToken(t, "ES256", "ec", claims(nil), tp.signES256), false},
+		{"audience array", makeIDToken(t, "RS256", "rsa", claims(map[string]interface{}{"aud": []string{"other", "client"}}), tp.signRS256), false},
+		{"wrong nonce", makeIDToken(t, "RS256", "rsa", claims(map[string]interface{}{"nonce": "other"}), tp.signRS256), true},
+		{"missing nonce", makeIDToken(t, "RS256", "rsa", claims(map[string]interface{}{"nonce": ""}), tp.signRS256), true},
+		{"wrong audience", makeIDToken(t, "RS256", "rsa", claims(map[string]interface{}{"aud": "other"}), tp.signRS256), true},
+		{"wrong issuer", makeIDToken(t, "RS256", "rsa", claims(map[string]interface{}{"iss": "https://evil.example.com"}), tp.signRS256), true},
+		{"expired", makeIDToken(t, "RS256", "rsa", claims(map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()}), tp.signRS256), true},
+		{"issued in the future", makeIDToken(t, "RS256", "rsa", claims(map[string]interface{}{"iat": now.Add(2 * time.Minute).Unix()}), tp.signRS256), true},
+		{"ES256 with an RSA key", makeIDToken(t, "ES256", "rsa", claims(nil), tp.signRS256), true},
+		{"RS256 with an EC key", makeIDToken(t, "RS256", "ec", claims(nil), tp.signES256), true},
+		{"alg none", makeIDToken(t, "none", "rsa", claims(nil), none), true},
+		{"off-curve EC key", makeIDToken(t, "ES256", "off-curve", claims(nil), tp.signES256), true},
+		{"unknown kid", makeIDToken(t, "RS256", "other", claims(nil), tp.signRS256), true},
+		{"signed by another key", makeIDToken(t, "ES256", "ec", claims(nil), newTestProvider(t).signES256), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := provider.Verify(context.Background(), tt.token, "nonce", now)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidIDToken) {
+					t.Fatalf("Verify() error = %v; want %v", err, ErrInvalidIDToken)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if got.Subject != "user-1" || got.Email != "alice@example.com" {
+				t.Errorf("Verify() claims = %+v", got)
+			}
+		})
+	}
+}
+
+func TestPublicKeyRejectsOffCurvePoint(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		y       *big.Int
+		wantErr bool
+	}{
+		{"on the curve", key.Y, false},
+		{"off the curve", new(big.Int).Add(key.Y, big.NewInt(1)), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := jwk{KeyType: "EC", Curve: "P-256", X: encoding.EncodeToString(key.X.Bytes()), Y: encoding.EncodeToString(tt.y.Bytes())}
+			_, err := k.publicKey()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("publicKey() error = %v; wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
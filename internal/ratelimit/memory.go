@@ -0,0 +1,55 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Memory is a Limiter which keeps the buckets in process memory.
+type Memory struct {
+	rps   float64
+	burst int
+	mu    sync.Mutex
+	// Each client has a rate limiter and the time it was last seen.
+	clients map[string]*client
+}
+
+type client struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewMemory returns a Memory limiter, and starts a background goroutine which forgets
+// about clients which haven't been seen for three minutes.
+func NewMemory(rps float64, burst int) *Memory {
+	m := &Memory{rps: rps, burst: burst, clients: make(map[string]*client)}
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			m.mu.Lock()
+			for key, client := range m.clients {
+				if time.Since(client.lastSeen) > 3*time.Minute {
+					delete(m.clients, key)
+				}
+			}
+			m.mu.Unlock()
+		}
+	}()
+	return m
+}
+
+// Allow takes a token from the client's bucket, if there is one.
+func (m *Memory) Allow(ctx context.Context, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, found := m.clients[key]
+	if !found {
+		c = &client{limiter: rate.NewLimiter(rate.Limit(m.rps), m.burst)}
+		m.clients[key] = c
+	}
+	c.lastSeen = time.Now()
+	return c.limiter.Allow(), nil
+}
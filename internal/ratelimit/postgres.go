@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Postgres is a Limiter which keeps the buckets in the rate_limits table, so that they
+// are shared between API servers. Each check is a single statement, which refills the
+// client's bucket for the time since it was last updated and takes a token if there
+// is one. The database's clock is used throughout, so the servers' clocks don't need
+// to agree.
+type Postgres struct {
+	db    *sql.DB
+	rps   float64
+	burst int
+}
+
+// NewPostgres returns a Postgres limiter, and starts a background goroutine which
+// deletes the buckets of clients which haven't been seen for a while. By then their
+// buckets would be full again, so deleting them doesn't change anything.
+func NewPostgres(db *sql.DB, rps float64, burst int) *Postgres {
+	p := &Postgres{db: db, rps: rps, burst: burst}
+	idle := 3 * time.Minute
+	if rps > 0 {
+		if full := time.Duration(float64(burst) / rps * float64(time.Second)); full > idle {
+			idle = full
+		}
+	}
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			p.db.ExecContext(ctx, `DELETE FROM rate_limits WHERE updated_at < NOW() - $1::float8 * interval '1 second'`, idle.Seconds())
+			cancel()
+		}
+	}()
+	return p
+}
+
+// Allow takes a token from the client's bucket, if there is one, creating a full
+// bucket for clients which haven't been seen before.
+func (p *Postgres) Allow(ctx context.Context, key string) (bool, error) {
+	query := `
+INSERT INTO rate_limits AS bucket (key, tokens, allowed, updated_at)
+VALUES ($1, $3::float8 - 1, $3::float8 >= 1, NOW())
+ON CONFLICT (key) DO UPDATE SET (tokens, allowed, updated_at) = (
+	SELECT refill.tokens - CASE WHEN refill.tokens >= 1 THEN 1 ELSE 0 END, refill.tokens >= 1, NOW()
+	FROM (
+		SELECT LEAST($3::float8, bucket.tokens + EXTRACT(EPOCH FROM NOW() - bucket.updated_at)::float8 * $2::float8) AS tokens
+	) AS refill
+)
+RETURNING bucket.allowed`
+	var allowed bool
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	err := p.db.QueryRowContext(ctx, query, key, p.rps, float64(p.burst)).Scan(&allowed)
+	return allowed, err
+}
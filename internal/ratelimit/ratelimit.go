@@ -0,0 +1,14 @@
+// Package ratelimit limits how often clients can make requests, using token buckets:
+// each client can make burst requests at once, and then rps requests per second on
+// average. The buckets can be kept in process memory, which is fine for a single API
+// server, or in PostgreSQL, so that every server behind a load balancer shares the
+// same limits and they survive restarts.
+package ratelimit
+
+import "context"
+
+// A Limiter decides whether a client may make another request. Clients are identified
+// by a key, such as their IP address.
+type Limiter interface {
+	Allow(ctx context.Context, key string) (bool, error)
+}
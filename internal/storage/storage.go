@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Define an error that is returned when a key would escape the storage root (for
+// example "../../etc/passwd").
+var ErrInvalidKey = errors.New("invalid storage key")
+
+// Storage is the interface for anywhere we can keep uploaded files. Keys are
+// slash-separated paths like "gifts/12/3f9a/original.jpg". The local filesystem
+// implementation below is the only one for now, but anything with the same shape (an
+// S3-compatible bucket, for example) can be dropped in without touching the handlers.
+type Storage interface {
+	// Put stores the contents of r under the given key, replacing anything already
+	// there.
+	Put(key string, r io.Reader, contentType string) error
+	// Delete removes every object whose key starts with the given prefix. It is not
+	// an error if there is nothing to delete.
+	Delete(prefix string) error
+	// URL returns the public URL that clients can fetch the object from.
+	URL(key string) string
+}
+
+// Local stores files in a directory on the local filesystem and serves them itself
+// under BaseURL.
+type Local struct {
+	dir     string
+	baseURL string
+}
+
+// NewLocal returns a Local storage rooted at dir, creating the directory if it doesn't
+// already exist.
+func NewLocal(dir, baseURL string) (*Local, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &Local{dir: dir, baseURL: strings.TrimSuffix(baseURL, "/")}, nil
+}
+
+// The path() method converts a key into a path inside the storage directory, making
+// sure that it can't point anywhere outside of it.
+func (s *Local) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" || strings.Contains(key, "..") {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(clean)), nil
+}
+
+func (s *Local) Put(key string, r io.Reader, contentType string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(p), 0o755)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first and rename it into place, so that a reader
+	// never sees a partially written file.
+	f, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+func (s *Local) Delete(prefix string) error {
+	p, err := s.path(prefix)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+func (s *Local) URL(key string) string {
+	return s.baseURL + "/" + strings.TrimPrefix(key, "/")
+}
+
+// ServeHTTP serves the stored files. It expects the request path to have had the
+// base URL stripped already, and never lists directories.
+func (s *Local) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p, err := s.path(r.URL.Path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	info, err := os.Stat(p)
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, p)
+}
@@ -0,0 +1,59 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// The SHA-1 test vectors from Appendix B of RFC 6238. The RFC lists eight digit codes,
+// so we compare the last six digits.
+func TestCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got := Code(secret, Step(time.Unix(tt.unix, 0)))
+		if got != tt.want {
+			t.Errorf("Code at %d = %q; want %q", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+	tests := []struct {
+		name     string
+		code     string
+		skew     int
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", Code(secret, step), 0, step, true},
+		{"previous step within skew", Code(secret, step-1), 1, step - 1, true},
+		{"next step within skew", Code(secret, step+1), 1, step + 1, true},
+		{"previous step without skew", Code(secret, step-1), 0, 0, false},
+		{"outside skew", Code(secret, step-2), 1, 0, false},
+		{"wrong code", "000000", 1, 0, false},
+		{"too short", Code(secret, step)[:5], 1, 0, false},
+		{"too long", Code(secret, step) + "0", 1, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, gotOK := Validate(secret, tt.code, now, tt.skew)
+			if gotStep != tt.wantStep || gotOK != tt.wantOK {
+				t.Errorf("Validate(%q, skew %d) = %d, %t; want %d, %t", tt.code, tt.skew, gotStep, gotOK, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,2 @@
+ALTER TABLE gifts DROP CONSTRAINT IF EXISTS gifts_preparation_check;
+ALTER TABLE gifts DROP COLUMN IF EXISTS preparation;
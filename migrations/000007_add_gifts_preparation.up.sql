@@ -0,0 +1,2 @@
+ALTER TABLE gifts ADD COLUMN IF NOT EXISTS preparation integer NOT NULL DEFAULT 0;
+ALTER TABLE gifts ADD CONSTRAINT gifts_preparation_check CHECK (preparation >= 0);
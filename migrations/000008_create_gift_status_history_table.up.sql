@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS gift_status_history (
+    id bigserial PRIMARY KEY,
+    gift_id bigint NOT NULL REFERENCES gifts ON DELETE CASCADE,
+    from_status text NOT NULL,
+    to_status text NOT NULL,
+    changed_by bigint REFERENCES users ON DELETE SET NULL,
+    changed_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS gift_status_history_gift_id_idx ON gift_status_history (gift_id, changed_at);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS gifts_search_idx;
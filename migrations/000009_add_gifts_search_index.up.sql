@@ -0,0 +1,3 @@
+-- The text search configuration here must match the -search-config flag passed to the
+-- API (english by default), otherwise PostgreSQL can't use this index for searches.
+CREATE INDEX IF NOT EXISTS gifts_search_idx ON gifts USING GIN ((setweight(to_tsvector('english', title), 'A') || setweight(to_tsvector('english', description), 'B')));
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS gift_images (
+    id bigserial PRIMARY KEY,
+    gift_id bigint NOT NULL REFERENCES gifts ON DELETE CASCADE,
+    storage_prefix text NOT NULL,
+    content_type text NOT NULL,
+    position integer NOT NULL,
+    is_primary bool NOT NULL DEFAULT false,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS gift_images_gift_id_idx ON gift_images (gift_id, position);
+-- Each gift can have at most one primary image.
+CREATE UNIQUE INDEX IF NOT EXISTS gift_images_primary_idx ON gift_images (gift_id) WHERE is_primary;
@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'orders:manage';
+DROP TABLE IF EXISTS order_items;
+DROP TABLE IF EXISTS orders;
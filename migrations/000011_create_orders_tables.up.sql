@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS orders (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    status text NOT NULL DEFAULT 'pending',
+    recipient_name text NOT NULL,
+    delivery_date date NOT NULL,
+    gift_message text NOT NULL DEFAULT '',
+    version integer NOT NULL DEFAULT 1
+);
+ALTER TABLE orders ADD CONSTRAINT orders_status_check CHECK (status IN ('pending', 'confirmed', 'shipped', 'delivered', 'cancelled'));
+CREATE INDEX IF NOT EXISTS orders_user_id_idx ON orders (user_id);
+CREATE TABLE IF NOT EXISTS order_items (
+    id bigserial PRIMARY KEY,
+    order_id bigint NOT NULL REFERENCES orders ON DELETE CASCADE,
+    gift_id bigint REFERENCES gifts ON DELETE SET NULL,
+    quantity integer NOT NULL,
+    engraving_text text NOT NULL DEFAULT ''
+);
+ALTER TABLE order_items ADD CONSTRAINT order_items_quantity_check CHECK (quantity > 0);
+CREATE INDEX IF NOT EXISTS order_items_order_id_idx ON order_items (order_id);
+INSERT INTO permissions (code)
+VALUES
+    ('orders:manage');
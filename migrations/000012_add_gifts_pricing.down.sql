@@ -0,0 +1,6 @@
+DELETE FROM permissions WHERE code = 'pricing:write';
+DROP TABLE IF EXISTS superiority_multipliers;
+ALTER TABLE gifts DROP CONSTRAINT IF EXISTS gifts_price_currency_check;
+ALTER TABLE gifts DROP CONSTRAINT IF EXISTS gifts_price_amount_check;
+ALTER TABLE gifts DROP COLUMN IF EXISTS price_currency;
+ALTER TABLE gifts DROP COLUMN IF EXISTS price_amount;
@@ -0,0 +1,14 @@
+ALTER TABLE gifts ADD COLUMN IF NOT EXISTS price_amount bigint NOT NULL DEFAULT 0;
+ALTER TABLE gifts ADD COLUMN IF NOT EXISTS price_currency text NOT NULL DEFAULT 'USD';
+ALTER TABLE gifts ADD CONSTRAINT gifts_price_amount_check CHECK (price_amount >= 0);
+ALTER TABLE gifts ADD CONSTRAINT gifts_price_currency_check CHECK (price_currency ~ '^[A-Z]{3}$');
+CREATE TABLE IF NOT EXISTS superiority_multipliers (
+    superiority text PRIMARY KEY,
+    multiplier numeric(6, 3) NOT NULL,
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+ALTER TABLE superiority_multipliers ADD CONSTRAINT superiority_multipliers_superiority_check CHECK (superiority IN ('silver', 'gold', 'diamond'));
+ALTER TABLE superiority_multipliers ADD CONSTRAINT superiority_multipliers_multiplier_check CHECK (multiplier > 0);
+INSERT INTO permissions (code)
+VALUES
+    ('pricing:write');
@@ -0,0 +1,8 @@
+DELETE FROM permissions WHERE code = 'categories:write';
+ALTER TABLE gifts ADD COLUMN IF NOT EXISTS category text NOT NULL DEFAULT '';
+UPDATE gifts SET category = categories.name
+FROM categories
+WHERE categories.id = gifts.category_id;
+ALTER TABLE gifts ALTER COLUMN category DROP DEFAULT;
+ALTER TABLE gifts DROP COLUMN IF EXISTS category_id;
+DROP TABLE IF EXISTS categories;
@@ -0,0 +1,50 @@
+CREATE TABLE IF NOT EXISTS categories (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    slug text UNIQUE NOT NULL,
+    name text NOT NULL,
+    parent_id bigint REFERENCES categories ON DELETE RESTRICT,
+    version integer NOT NULL DEFAULT 1
+);
+ALTER TABLE categories ADD CONSTRAINT categories_slug_check CHECK (slug ~ '^[a-z0-9]+(-[a-z0-9]+)*$');
+ALTER TABLE categories ADD CONSTRAINT categories_parent_check CHECK (parent_id <> id);
+CREATE INDEX IF NOT EXISTS categories_parent_id_idx ON categories (parent_id);
+
+-- Move the existing free-text categories into the new table. Values which only differ
+-- by case or punctuation ("Jewelry" and "jewelry") end up as a single category. Values
+-- which are spelled differently ("jewellery") still need merging by hand afterwards.
+-- Values with no Latin letters or digits (like Cyrillic names) can't be turned into a
+-- slug, so each distinct one gets a numbered slug ("category-1") to be renamed later.
+-- Only blank values end up in the "uncategorized" category.
+CREATE TEMPORARY TABLE category_slugs AS
+SELECT DISTINCT category, trim(BOTH '-' FROM regexp_replace(lower(trim(category)), '[^a-z0-9]+', '-', 'g')) AS slug
+FROM gifts;
+UPDATE category_slugs SET slug = numbered.slug
+FROM (
+    SELECT name, 'category-' || row_number() OVER (ORDER BY name) AS slug
+    FROM (
+        SELECT DISTINCT lower(trim(category)) AS name
+        FROM category_slugs
+        WHERE slug = '' AND trim(category) <> ''
+    ) AS unslugged
+) AS numbered
+WHERE category_slugs.slug = '' AND lower(trim(category_slugs.category)) = numbered.name;
+UPDATE category_slugs SET slug = 'uncategorized' WHERE slug = '';
+INSERT INTO categories (slug, name)
+SELECT slug, COALESCE(min(NULLIF(trim(category), '')), 'Uncategorized')
+FROM category_slugs
+GROUP BY slug
+ON CONFLICT (slug) DO NOTHING;
+
+ALTER TABLE gifts ADD COLUMN IF NOT EXISTS category_id bigint REFERENCES categories ON DELETE RESTRICT;
+UPDATE gifts SET category_id = categories.id
+FROM category_slugs, categories
+WHERE category_slugs.category = gifts.category AND categories.slug = category_slugs.slug;
+DROP TABLE category_slugs;
+ALTER TABLE gifts ALTER COLUMN category_id SET NOT NULL;
+ALTER TABLE gifts DROP COLUMN IF EXISTS category;
+CREATE INDEX IF NOT EXISTS gifts_category_id_idx ON gifts (category_id);
+
+INSERT INTO permissions (code)
+VALUES
+    ('categories:write');
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS gifts_tags_idx;
+ALTER TABLE gifts DROP COLUMN IF EXISTS tags;
@@ -0,0 +1,2 @@
+ALTER TABLE gifts ADD COLUMN IF NOT EXISTS tags text[] NOT NULL DEFAULT '{}';
+CREATE INDEX IF NOT EXISTS gifts_tags_idx ON gifts USING GIN (tags);
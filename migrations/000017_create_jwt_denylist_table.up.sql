@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS jwt_denylist (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    jti text NOT NULL DEFAULT '',
+    -- Kept to the microsecond, so that it can be compared with the sub-second issued
+    -- at times of JWTs.
+    created_at timestamp with time zone NOT NULL DEFAULT NOW(),
+    expiry timestamp(0) with time zone NOT NULL
+);
+CREATE INDEX IF NOT EXISTS jwt_denylist_expiry_idx ON jwt_denylist (expiry);
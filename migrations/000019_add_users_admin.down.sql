@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code = 'users:admin';
+ALTER TABLE users DROP COLUMN IF EXISTS disabled;
@@ -0,0 +1,4 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled boolean NOT NULL DEFAULT false;
+INSERT INTO permissions (code)
+VALUES
+    ('users:admin');
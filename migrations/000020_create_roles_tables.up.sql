@@ -0,0 +1,38 @@
+CREATE TABLE IF NOT EXISTS roles (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    name text NOT NULL UNIQUE,
+    description text NOT NULL DEFAULT '',
+    version integer NOT NULL DEFAULT 1
+);
+CREATE TABLE IF NOT EXISTS roles_permissions (
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+CREATE TABLE IF NOT EXISTS users_roles (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+-- Wildcard codes grant every permission with the same prefix.
+INSERT INTO permissions (code)
+VALUES
+    ('*'),
+    ('gifts:*');
+INSERT INTO roles (name, description)
+VALUES
+    ('customer', 'Browses gifts and places orders'),
+    ('staff', 'Manages the gift catalogue and fulfils orders'),
+    ('admin', 'Has every permission');
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE (roles.name, permissions.code) IN (
+    ('customer', 'gifts:read'),
+    ('staff', 'gifts:*'),
+    ('staff', 'categories:write'),
+    ('staff', 'pricing:write'),
+    ('staff', 'orders:manage'),
+    ('admin', '*')
+);
@@ -0,0 +1,4 @@
+DELETE FROM permissions WHERE code = 'gifts:write:own';
+UPDATE permissions SET code = 'gifts:write' WHERE code = 'gifts:write:any';
+DROP INDEX IF EXISTS gifts_created_by_idx;
+ALTER TABLE gifts DROP COLUMN IF EXISTS created_by;
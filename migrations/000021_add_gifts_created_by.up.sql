@@ -0,0 +1,8 @@
+ALTER TABLE gifts ADD COLUMN IF NOT EXISTS created_by bigint REFERENCES users ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS gifts_created_by_idx ON gifts (created_by);
+-- The old gifts:write permission let users edit any gift, so existing grants keep
+-- that meaning under the new name.
+UPDATE permissions SET code = 'gifts:write:any' WHERE code = 'gifts:write';
+INSERT INTO permissions (code)
+VALUES
+    ('gifts:write:own');
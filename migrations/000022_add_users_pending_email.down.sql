@@ -0,0 +1,3 @@
+DELETE FROM jwt_denylist WHERE user_id NOT IN (SELECT id FROM users);
+ALTER TABLE jwt_denylist ADD CONSTRAINT jwt_denylist_user_id_fkey FOREIGN KEY (user_id) REFERENCES users ON DELETE CASCADE;
+ALTER TABLE users DROP COLUMN IF EXISTS pending_email;
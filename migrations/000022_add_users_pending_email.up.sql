@@ -0,0 +1,4 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS pending_email citext;
+-- Revocations must outlive the user, so that deleting an account also stops its JWTs
+-- from working.
+ALTER TABLE jwt_denylist DROP CONSTRAINT IF EXISTS jwt_denylist_user_id_fkey;
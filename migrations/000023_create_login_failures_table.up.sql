@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS login_failures (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    email citext NOT NULL,
+    ip text NOT NULL
+);
+CREATE INDEX IF NOT EXISTS login_failures_email_idx ON login_failures (email, created_at);
+CREATE INDEX IF NOT EXISTS login_failures_ip_idx ON login_failures (ip, created_at);
+-- Locks are keyed by email rather than user, so that unknown emails can be locked too
+-- and the responses don't give away which emails are registered.
+CREATE TABLE IF NOT EXISTS login_locks (
+    email citext PRIMARY KEY,
+    locked_until timestamp(0) with time zone NOT NULL
+);
@@ -0,0 +1,9 @@
+-- The token buckets for the PostgreSQL rate limiter. Losing them in a crash only
+-- resets the limits, so the table is unlogged to make the frequent updates cheaper.
+CREATE UNLOGGED TABLE IF NOT EXISTS rate_limits (
+    key text PRIMARY KEY,
+    tokens double precision NOT NULL,
+    allowed bool NOT NULL,
+    updated_at timestamp with time zone NOT NULL
+);
+CREATE INDEX IF NOT EXISTS rate_limits_updated_at_idx ON rate_limits (updated_at);